@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Role is what a user may do with a wiki, each role includes the ones before it
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleRead
+	RoleWrite
+	RoleAdmin
+)
+
+var roleNames = []string{"none", "read", "write", "admin"}
+
+// The ACL of this name applies to the wikis without their own,
+// and its admins are the admins of every wiki
+const c_aclDefault = "*"
+
+// Requests without credentials are made by this user if their role allows them
+const c_anonymousUser = "anonymous"
+
+func (this Role) String() string {
+	if this < RoleNone || this > RoleAdmin {
+		return roleNames[RoleNone]
+	}
+
+	return roleNames[this]
+}
+
+func (this Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.String())
+}
+
+func (this *Role) UnmarshalJSON(data []byte) error {
+	var name string
+
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+
+	for role, roleName := range roleNames {
+		if name == roleName {
+			*this = Role(role)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown role '%v'", name)
+}
+
+// WikiACL gives roles to the users of a wiki. The "*" user is any
+// logged in user and anonymous is the role of everyone else.
+type WikiACL struct {
+	Anonymous Role            `json:"anonymous"`
+	Users     map[string]Role `json:"users,omitempty"`
+	Groups    map[string]Role `json:"groups,omitempty"`
+}
+
+// ACL is the access control file, it has the groups of users
+// and the ACLs of the wikis by name
+type ACL struct {
+	Groups map[string][]string `json:"groups"`
+	Wikis  map[string]WikiACL  `json:"wikis"`
+}
+
+// The ACL file is read again whenever it changes, like the user file
+var aclCache = struct {
+	sync.Mutex
+	filename string
+	modTime  time.Time
+	size     int64
+	acl      *ACL
+}{}
+
+// aclLock is held while the admin API changes the ACL file
+var aclLock sync.Mutex
+
+// NewACL returns the ACL used without an ACL file, which lets everyone
+// read the wikis and the users change them. Only the given users are admins.
+func NewACL(admins []string) *ACL {
+	users := map[string]Role{"*": RoleWrite}
+
+	for _, admin := range admins {
+		users[admin] = RoleAdmin
+	}
+
+	return &ACL{
+		Groups: map[string][]string{},
+		Wikis: map[string]WikiACL{
+			c_aclDefault: WikiACL{
+				Anonymous: RoleRead,
+				Users:     users,
+			},
+		},
+	}
+}
+
+// ReadACLFile reads the ACL file, a missing file gives the default ACL
+// with the local users as the admins
+func ReadACLFile(filename string) (*ACL, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return NewACL(localUsers()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{}
+
+	err = json.Unmarshal(data, acl)
+	if err != nil {
+		return nil, err
+	}
+
+	if acl.Groups == nil {
+		acl.Groups = map[string][]string{}
+	}
+
+	if acl.Wikis == nil {
+		acl.Wikis = map[string]WikiACL{}
+	}
+
+	return acl, nil
+}
+
+func (this *ACL) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(this, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+// Role returns the role of a user on a wiki, user is empty if not logged in.
+// The user is also in the given groups, e.g. the ones of the identity provider.
+func (this *ACL) Role(wikiname string, user string, groups []string) Role {
+	return this.role(wikiname, user, groups, false)
+}
+
+// NamedRole returns the role a user has on a wiki by name or by group,
+// the roles of "*" and of anonymous don't count
+func (this *ACL) NamedRole(wikiname string, user string, groups []string) Role {
+	return this.role(wikiname, user, groups, true)
+}
+
+func (this *ACL) role(wikiname string, user string, groups []string, named bool) Role {
+	def, ok := this.Wikis[c_aclDefault]
+	if ok && this.wikiRole(def, user, groups, named) == RoleAdmin {
+		return RoleAdmin
+	}
+
+	wiki, ok := this.Wikis[wikiname]
+	if !ok {
+		wiki = def
+	}
+
+	return this.wikiRole(wiki, user, groups, named)
+}
+
+func (this *ACL) wikiRole(wiki WikiACL, user string, groups []string, named bool) Role {
+	role := wiki.Anonymous
+	if named {
+		role = RoleNone
+	}
+
+	if user == "" {
+		return role
+	}
+
+	roles := []Role{wiki.Users[user]}
+	if !named {
+		roles = append(roles, wiki.Users["*"])
+	}
+
+	for _, r := range roles {
+		if r > role {
+			role = r
+		}
+	}
+
+	for group, r := range wiki.Groups {
+		if r > role && this.inGroup(group, user, groups) {
+			role = r
+		}
+	}
+
+	return role
+}
+
+func (this *ACL) inGroup(group string, user string, groups []string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+
+	for _, member := range this.Groups[group] {
+		if member == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadACL returns the ACL file, which is only read again if it changed.
+// The returned ACL is shared, it must not be modified.
+func loadACL() (*ACL, error) {
+	filename := cfg().ACLFile
+
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return NewACL(localUsers()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aclCache.Lock()
+	defer aclCache.Unlock()
+
+	if aclCache.acl != nil && aclCache.filename == filename &&
+		aclCache.modTime.Equal(info.ModTime()) && aclCache.size == info.Size() {
+		return aclCache.acl, nil
+	}
+
+	acl, err := ReadACLFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	aclCache.filename = filename
+	aclCache.modTime = info.ModTime()
+	aclCache.size = info.Size()
+	aclCache.acl = acl
+
+	return acl, nil
+}
+
+// wikiRole returns the role of a user on a wiki, nobody has one if the
+// ACL file can't be read
+func wikiRole(wikiname string, user string, groups []string) Role {
+	acl, err := loadACL()
+	if err != nil {
+		log.Println("Error while reading the ACL file:", err)
+		return RoleNone
+	}
+
+	return acl.Role(wikiname, user, groups)
+}
+
+// authorizeACL checks whether the user of a request may change the ACL of a
+// wiki, which needs an admin named in the ACL by user or by group. Being an
+// admin as one of "*" isn't enough.
+func authorizeACL(w http.ResponseWriter, r *http.Request, wikiname string) (string, bool) {
+	user, ok := authorize(w, r, wikiname, RoleAdmin)
+	if !ok {
+		return "", false
+	}
+
+	acl, err := loadACL()
+	if err != nil {
+		http.Error(w, "Couldn't read the ACL!", http.StatusInternalServerError)
+		log.Println("Error while reading the ACL file:", err)
+		return "", false
+	}
+
+	login, _ := requestUser(r)
+
+	if acl.NamedRole(wikiname, login.User, login.Groups) < RoleAdmin {
+		http.Error(w, "Only the admins named in the ACL may change it!", http.StatusForbidden)
+		return "", false
+	}
+
+	return user, true
+}
+
+// changeACL applies a change to the ACL file
+func changeACL(change func(acl *ACL)) error {
+	aclLock.Lock()
+	defer aclLock.Unlock()
+
+	acl, err := ReadACLFile(cfg().ACLFile)
+	if err != nil {
+		return err
+	}
+
+	change(acl)
+
+	return acl.WriteFile(cfg().ACLFile)
+}
+
+func getACL(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, c_aclDefault, RoleAdmin); !ok {
+		return
+	}
+
+	acl, err := loadACL()
+	if err != nil {
+		http.Error(w, "Couldn't read the ACL!", http.StatusInternalServerError)
+		log.Println("Error while reading the ACL file:", err)
+		return
+	}
+
+	writeJSON(w, acl)
+}
+
+// putACL replaces the whole ACL file, only the admins of every wiki may do it
+func putACL(w http.ResponseWriter, r *http.Request) {
+	user, ok := authorizeACL(w, r, c_aclDefault)
+	if !ok {
+		return
+	}
+
+	acl := &ACL{}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(acl)
+	if err != nil {
+		http.Error(w, "Invalid ACL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = changeACL(func(current *ACL) {
+		*current = *acl
+	})
+	if err != nil {
+		http.Error(w, "Couldn't store the ACL!", http.StatusInternalServerError)
+		log.Println("Error while writing the ACL file:", err)
+		return
+	}
+
+	log.Printf("The ACL was changed by '%v'\n", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getWikiACL(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleAdmin); !ok {
+		return
+	}
+
+	acl, err := loadACL()
+	if err != nil {
+		http.Error(w, "Couldn't read the ACL!", http.StatusInternalServerError)
+		log.Println("Error while reading the ACL file:", err)
+		return
+	}
+
+	wiki, ok := acl.Wikis[wikiname]
+	if !ok {
+		http.Error(w, "The wiki has no ACL of its own!", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, wiki)
+}
+
+func putWikiACL(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	user, ok := authorizeACL(w, r, wikiname)
+	if !ok {
+		return
+	}
+
+	wiki := WikiACL{}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&wiki)
+	if err != nil {
+		http.Error(w, "Invalid ACL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = changeACL(func(acl *ACL) {
+		acl.Wikis[wikiname] = wiki
+	})
+	if err != nil {
+		http.Error(w, "Couldn't store the ACL!", http.StatusInternalServerError)
+		log.Println("Error while writing the ACL file:", err)
+		return
+	}
+
+	log.Printf("The ACL of '%v' was changed by '%v'\n", wikiname, user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteWikiACL makes the default ACL apply to the wiki again
+func deleteWikiACL(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	user, ok := authorizeACL(w, r, wikiname)
+	if !ok {
+		return
+	}
+
+	err := changeACL(func(acl *ACL) {
+		delete(acl.Wikis, wikiname)
+	})
+	if err != nil {
+		http.Error(w, "Couldn't store the ACL!", http.StatusInternalServerError)
+		log.Println("Error while writing the ACL file:", err)
+		return
+	}
+
+	log.Printf("The ACL of '%v' was removed by '%v'\n", wikiname, user)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDefaultACL(t *testing.T) {
+	acl := NewACL([]string{"alice"})
+
+	tests := []struct {
+		user   string
+		groups []string
+		role   Role
+	}{
+		{"", nil, RoleRead},
+		{"alice", nil, RoleAdmin},
+		{"bob", nil, RoleWrite},
+		{"oidc:alice", []string{"admins"}, RoleWrite},
+	}
+
+	for _, test := range tests {
+		if role := acl.Role("notes.html", test.user, test.groups); role != test.role {
+			t.Errorf("role of %q = %v, want %v", test.user, role, test.role)
+		}
+	}
+}
+
+func TestNamedRole(t *testing.T) {
+	acl := &ACL{
+		Groups: map[string][]string{"team": {"carol"}},
+		Wikis: map[string]WikiACL{
+			c_aclDefault: {
+				Anonymous: RoleAdmin,
+				Users:     map[string]Role{"*": RoleAdmin, "alice": RoleAdmin},
+			},
+			"team.html": {
+				Groups: map[string]Role{"team": RoleAdmin},
+			},
+		},
+	}
+
+	tests := []struct {
+		wiki  string
+		user  string
+		role  Role
+		named Role
+	}{
+		{"notes.html", "", RoleAdmin, RoleNone},
+		{"notes.html", "alice", RoleAdmin, RoleAdmin},
+		{"notes.html", "bob", RoleAdmin, RoleNone},
+		{"team.html", "carol", RoleAdmin, RoleAdmin},
+		{"notes.html", "carol", RoleAdmin, RoleNone},
+	}
+
+	for _, test := range tests {
+		if role := acl.Role(test.wiki, test.user, nil); role != test.role {
+			t.Errorf("role of %q on %v = %v, want %v", test.user, test.wiki, role, test.role)
+		}
+
+		if role := acl.NamedRole(test.wiki, test.user, nil); role != test.named {
+			t.Errorf("named role of %q on %v = %v, want %v", test.user, test.wiki, role, test.named)
+		}
+	}
+}
+
+// Only the admins named in the ACL may change it, the admins of "*" may not
+func TestChangeACL(t *testing.T) {
+	useTestServer(t)
+
+	users := NewUserFile()
+	for _, name := range []string{"alice", "bob"} {
+		if err := users.Add(name, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := users.WriteFile(cfg().UserFile); err != nil {
+		t.Fatal(err)
+	}
+
+	router := getRouter()
+
+	request := func(user string, body string) int {
+		req := httptest.NewRequest("PUT", "/api/acl", strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// Without an ACL file, the local users are the admins
+	acl := `{"wikis": {"*": {"anonymous": "read", "users": {"*": "admin", "alice": "admin"}}}}`
+
+	if code := request("", acl); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous: status = %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	if code := request("bob", acl); code != http.StatusNoContent {
+		t.Fatalf("bob as a local user: status = %v, want %v", code, http.StatusNoContent)
+	}
+
+	// Now bob is an admin only as one of "*"
+	if code := request("bob", acl); code != http.StatusForbidden {
+		t.Fatalf("bob as one of *: status = %v, want %v", code, http.StatusForbidden)
+	}
+
+	if code := request("alice", acl); code != http.StatusNoContent {
+		t.Fatalf("alice by name: status = %v, want %v", code, http.StatusNoContent)
+	}
+}
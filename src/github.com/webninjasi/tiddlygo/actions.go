@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"os/exec"
 	"path/filepath"
 	"strconv"
@@ -11,9 +10,15 @@ import (
 )
 
 var (
-	ErrNoCommand = errors.New("No command specified to run!")
+	ErrNoCommand         = errors.New("No command specified to run!")
+	ErrNoGitCommand      = errors.New("No git command specified!")
+	ErrInvalidGitCommand = errors.New("Invalid git command!")
+	ErrNoFileSpecified   = errors.New("No file specified!")
 )
 
+// The commands of the git action
+var gitActionCommands = []string{"init", "add", "commit", "push", "pull"}
+
 type EventActioner interface {
 	Do(...string) error
 	CombineArgs([]string) []string
@@ -67,34 +72,74 @@ type EventActionGit struct {
 	EventAction
 }
 
-func (this EventActionGit) Do(args ...string) (err error) {
-	switch args[0] {
-	case "add":
-		filename := args[1]
-		_, err = gitAdd(filename)
-	case "commit":
-		_, err = gitCommit("Update from tiddlygo", "")
+// NewEventActionGit fills in the event args for the git commands
+// which are given without parameters
+func NewEventActionGit(data []string) EventActionGit {
+	if len(data) == 1 {
+		switch strings.ToLower(data[0]) {
+		case "add":
+			data = []string{data[0], "$0"}
+		case "commit":
+			data = []string{data[0], "$0", "$1"}
+		}
 	}
 
-	return
+	return EventActionGit{EventAction{data}}
 }
 
-func gitAdd(filename string) (string, error) {
-	return runGitCmd(exec.Command("git", "add", filename))
+func (this EventActionGit) Do(args ...string) error {
+	if len(args) == 0 {
+		return ErrNoGitCommand
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "init":
+		gitLock.Lock()
+		defer gitLock.Unlock()
+
+		_, err := openGitRepo()
+		return err
+	case "add":
+		if len(args) < 2 || args[1] == "" {
+			return ErrNoFileSpecified
+		}
+
+		return gitAdd(args[1])
+	case "commit":
+		var wikiname, user string
+
+		if len(args) > 1 {
+			wikiname = args[1]
+		}
+
+		if len(args) > 2 {
+			user = args[2]
+		}
+
+		return gitCommit(wikiname, user)
+	case "push", "pull":
+		// Talking to the remote might be slow, so it is done in the background
+		gitSyncer.Enqueue(strings.ToLower(args[0]))
+		return nil
+	}
+
+	return ErrInvalidGitCommand
 }
 
-func gitCommit(msg string, author string) (string, error) {
-	if author != "" {
-		return runGitCmd(exec.Command("git", "commit", "-m", msg, fmt.Sprintf("--author='%s <system@tiddlygo>'", author)))
+func isGitActionCommand(command string) bool {
+	for _, c := range gitActionCommands {
+		if strings.ToLower(command) == c {
+			return true
+		}
 	}
 
-	return runGitCmd(exec.Command("git", "commit", "-m", msg))
+	return false
 }
 
 func runCmd(cmd *exec.Cmd) (string, string, error) {
 	var err error
 
-	cmd.Dir, err = filepath.Abs(cfg.WikiDir)
+	cmd.Dir, err = filepath.Abs(cfg().WikiDir)
 	if err != nil {
 		return "", "", err
 	}
@@ -116,20 +161,6 @@ func runWikiCmd(cmd *exec.Cmd) (string, error) {
 	return out, err
 }
 
-func runGitCmd(cmd *exec.Cmd) (string, error) {
-	out, errstr, err := runCmd(cmd)
-
-	if err != nil {
-		if len(errstr) == 0 {
-			err = nil
-		} else {
-			err = errors.New(errstr)
-		}
-	}
-
-	return out, err
-}
-
 func getEventAction(action string, data []string) EventActioner {
 	action = strings.ToLower(action)
 
@@ -137,7 +168,7 @@ func getEventAction(action string, data []string) EventActioner {
 	case "cmd":
 		return EventActionCmd{EventAction{data}}
 	case "git":
-		return EventActionGit{EventAction{data}}
+		return NewEventActionGit(data)
 	}
 
 	return nil
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+const c_defaultPageSize = 100
+const c_maxPageSize = 1000
+
+type TiddlerSummary struct {
+	Title    string     `json:"title"`
+	Tags     []string   `json:"tags"`
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+type TiddlerDetail struct {
+	Title    string            `json:"title"`
+	Tags     []string          `json:"tags"`
+	Created  *time.Time        `json:"created,omitempty"`
+	Modified *time.Time        `json:"modified,omitempty"`
+	Fields   map[string]string `json:"fields"`
+	Text     string            `json:"text"`
+}
+
+type TiddlerList struct {
+	Total    int              `json:"total"`
+	Offset   int              `json:"offset"`
+	Limit    int              `json:"limit"`
+	Tiddlers []TiddlerSummary `json:"tiddlers"`
+}
+
+type parsedWiki struct {
+	modTime time.Time
+	size    int64
+	wiki    *tiddlywiki.Wiki
+}
+
+// wikiCache keeps the parsed wikis until their files change
+var wikiCache = struct {
+	sync.Mutex
+	wikis map[string]parsedWiki
+}{wikis: map[string]parsedWiki{}}
+
+// loadWiki parses a wiki or returns it from the cache if it didn't change.
+// The returned wiki is shared, it must not be modified.
+func loadWiki(wikiname string) (*tiddlywiki.Wiki, error) {
+	info, err := wikiStore().Stat(wikiname)
+	if err != nil {
+		return nil, err
+	}
+
+	wikiCache.Lock()
+	cached, ok := wikiCache.wikis[wikiname]
+	wikiCache.Unlock()
+
+	if ok && cached.modTime.Equal(info.ModTime) && cached.size == info.Size {
+		return cached.wiki, nil
+	}
+
+	content, err := readWiki(wikiname)
+	if err != nil {
+		return nil, err
+	}
+
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	wikiCache.Lock()
+	wikiCache.wikis[wikiname] = parsedWiki{info.ModTime, info.Size, wiki}
+	wikiCache.Unlock()
+
+	return wiki, nil
+}
+
+func listTiddlers(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	wiki, ok := apiWiki(w, wikiname)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	tag := query.Get("tag")
+	system := query.Get("system") == "true" || query.Get("system") == "1"
+
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = c_defaultPageSize
+	}
+	if limit > c_maxPageSize {
+		limit = c_maxPageSize
+	}
+
+	matched := []*tiddlywiki.Tiddler{}
+
+	for _, tiddler := range wiki.Tiddlers() {
+		if tiddler.IsSystem() && !system {
+			continue
+		}
+
+		if tag != "" && !tiddler.HasTag(tag) {
+			continue
+		}
+
+		matched = append(matched, tiddler)
+	}
+
+	data := TiddlerList{
+		Total:    len(matched),
+		Offset:   offset,
+		Limit:    limit,
+		Tiddlers: []TiddlerSummary{},
+	}
+
+	for idx := offset; idx < len(matched) && idx < offset+limit; idx++ {
+		tiddler := matched[idx]
+
+		data.Tiddlers = append(data.Tiddlers, TiddlerSummary{
+			Title:    tiddler.Title,
+			Tags:     tiddler.Tags,
+			Modified: optionalTime(tiddler.Modified),
+		})
+	}
+
+	writeJSON(w, data)
+}
+
+func getTiddler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	wiki, ok := apiWiki(w, wikiname)
+	if !ok {
+		return
+	}
+
+	title, err := url.PathUnescape(params["title"])
+	if err != nil {
+		http.Error(w, "Invalid title!", http.StatusBadRequest)
+		return
+	}
+
+	tiddler := wiki.Tiddler(title)
+	if tiddler == nil {
+		http.Error(w, "Couldn't find the tiddler!", http.StatusNotFound)
+		return
+	}
+
+	fields := map[string]string{}
+	for name, value := range tiddler.Fields {
+		fields[name] = value
+	}
+
+	writeJSON(w, TiddlerDetail{
+		Title:    tiddler.Title,
+		Tags:     tiddler.Tags,
+		Created:  optionalTime(tiddler.Created),
+		Modified: optionalTime(tiddler.Modified),
+		Fields:   fields,
+		Text:     tiddler.Text,
+	})
+}
+
+// apiWiki loads a wiki and writes an error response if it fails
+func apiWiki(w http.ResponseWriter, wikiname string) (*tiddlywiki.Wiki, bool) {
+	wiki, err := loadWiki(wikiname)
+	if os.IsNotExist(err) {
+		http.Error(w, "Couldn't find the wiki!", http.StatusNotFound)
+		return nil, false
+	}
+	if err == tiddlywiki.ErrEncrypted || err == tiddlywiki.ErrNoStoreArea {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Couldn't read the wiki!", http.StatusInternalServerError)
+		log.Printf("Error while reading '%v': %v\n", wikiname, err)
+		return nil, false
+	}
+
+	return wiki, true
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	writeJSONStatus(w, http.StatusOK, data)
+}
+
+// writeJSONStatus writes the data with a status, which is only sent once
+// the data is encoded
+func writeJSONStatus(w http.ResponseWriter, status int, data interface{}) {
+	byt, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Couldn't encode the response!", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(byt)
+}
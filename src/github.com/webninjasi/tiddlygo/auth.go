@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkCredentials reports whether the given pair may store wikis.
+// Until the first user is added, the username and password of the config are used.
+func checkCredentials(user string, pass string) bool {
+	users, err := loadUsers()
+	if err != nil {
+		log.Println("Error while reading the users:", err)
+		return false
+	}
+
+	if len(users.Users) == 0 {
+		conf := cfg()
+
+		return conf.Username != "" &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(conf.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(conf.Password)) == 1
+	}
+
+	return users.Check(user, pass)
+}
+
+// Login is who a request is made by. The groups are the ones the identity
+// provider put the user in, and the token limits what the user may do if the
+// request was made with one.
+type Login struct {
+	User     string
+	Groups   []string
+	External bool
+	Token    *APIToken
+}
+
+// Role returns the role of the login on a wiki
+func (this Login) Role(wikiname string) Role {
+	role := wikiRole(wikiname, this.User, this.Groups)
+
+	if this.Token != nil {
+		return this.Token.Limit(wikiname, role)
+	}
+
+	return role
+}
+
+// requestUser returns the login of a request, made with an API token, with
+// HTTP Basic credentials or with the session cookie of the web UI. The
+// cookie only counts for changes sent by the pages of the server.
+func requestUser(r *http.Request) (Login, bool) {
+	if _, ok := bearerToken(r); ok {
+		return tokenLogin(r)
+	}
+
+	// Browsers also send the credentials they remember to the requests of other sites
+	if user, pass, ok := r.BasicAuth(); ok && checkCredentials(user, pass) {
+		if !isSafeMethod(r) && !checkOrigin(r) {
+			return Login{}, false
+		}
+
+		return Login{User: user}, true
+	}
+
+	_, session, ok := requestSession(r)
+	if !ok || (!isSafeMethod(r) && !checkCSRF(r, session)) {
+		return Login{}, false
+	}
+
+	return Login{User: session.User, Groups: session.Groups, External: session.External}, true
+}
+
+// authorize checks whether the user of a request has the role on a wiki.
+// Without a login, browsers are sent to the login page and the other
+// clients are asked for credentials; the others are refused.
+func authorize(w http.ResponseWriter, r *http.Request, wikiname string, role Role) (string, bool) {
+	login, ok := requestUser(r)
+
+	if login.Role(wikiname) >= role {
+		if !ok {
+			return c_anonymousUser, true
+		}
+
+		return login.User, true
+	}
+
+	if ok {
+		http.Error(w, "You aren't allowed to do that with this wiki!", http.StatusForbidden)
+		return "", false
+	}
+
+	askLogin(w, r)
+
+	return "", false
+}
+
+// askLogin answers a request which needs a login but hasn't got a valid one
+func askLogin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := bearerToken(r); ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="TiddlyGo", error="invalid_token"`)
+		http.Error(w, "Invalid API token!", http.StatusUnauthorized)
+		return
+	}
+
+	if _, _, ok := r.BasicAuth(); ok && !isSafeMethod(r) && !checkOrigin(r) {
+		http.Error(w, "Requests of other sites can't change anything!", http.StatusForbidden)
+		return
+	}
+
+	if _, _, ok := requestSession(r); ok && !isSafeMethod(r) {
+		http.Error(w, "Invalid CSRF token!", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	// The web UI goes to the login page itself instead of the browser's prompt
+	if r.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="TiddlyGo"`)
+	}
+
+	http.Error(w, "Username or password do not match!", http.StatusUnauthorized)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Browsers send the credentials they have to any site, so the changes need
+// proof that they come from a page of this server
+func TestCSRF(t *testing.T) {
+	useTestServer(t)
+	router := getRouter()
+
+	id, err := newSession(&Session{User: "tiddlygo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Lock()
+	csrf := sessions.byId[id].CSRF
+	sessions.Unlock()
+
+	t.Cleanup(func() {
+		deleteSession(id)
+	})
+
+	tests := []struct {
+		name    string
+		session bool
+		headers map[string]string
+		status  int
+	}{
+		{"basic auth without an origin", false, nil, http.StatusNoContent},
+		{"basic auth from this server", false, map[string]string{"Origin": "http://example.com"}, http.StatusNoContent},
+		{"basic auth from a page of this server", false, map[string]string{"Referer": "http://example.com/notes.html"}, http.StatusNoContent},
+		{"basic auth from another site", false, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"basic auth from a page of another site", false, map[string]string{"Referer": "http://evil.example/page.html"}, http.StatusForbidden},
+		{"basic auth from a file", false, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"session with the token", true, map[string]string{"X-CSRF-Token": csrf}, http.StatusNoContent},
+		{"session with a wrong token", true, map[string]string{"X-CSRF-Token": "wrong", "X-Requested-With": "TiddlyWiki", "Origin": "http://example.com"}, http.StatusForbidden},
+		{"session from tiddlywiki", true, map[string]string{"X-Requested-With": "TiddlyWiki", "Origin": "http://example.com"}, http.StatusNoContent},
+		{"session from tiddlywiki without an origin", true, map[string]string{"X-Requested-With": "TiddlyWiki"}, http.StatusForbidden},
+		{"session from another site", true, map[string]string{"X-Requested-With": "TiddlyWiki", "Origin": "http://evil.example"}, http.StatusForbidden},
+		{"session without anything", true, map[string]string{"Origin": "http://example.com"}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tiddlerURL("Tiddler"), strings.NewReader(`{"text":"one"}`))
+
+			if test.session {
+				req.AddCookie(&http.Cookie{Name: c_sessionCookie, Value: id})
+			} else {
+				req.SetBasicAuth("tiddlygo", "tiddlygo")
+			}
+
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", rec.Code, test.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+// A page of another site can't log the browser in, e.g. as the attacker
+func TestLoginOrigin(t *testing.T) {
+	useTestServer(t)
+	router := getRouter()
+
+	tests := []struct {
+		name     string
+		password string
+		headers  map[string]string
+		status   int
+		session  bool
+	}{
+		{"without an origin", "tiddlygo", nil, http.StatusSeeOther, true},
+		{"from this server", "tiddlygo", map[string]string{"Origin": "http://example.com"}, http.StatusSeeOther, true},
+		{"from the login page", "tiddlygo", map[string]string{"Referer": "http://example.com/login?next=%2F"}, http.StatusSeeOther, true},
+		{"with a wrong password", "wrong", map[string]string{"Origin": "http://example.com"}, http.StatusSeeOther, false},
+		{"from another site", "tiddlygo", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden, false},
+		{"from a page of another site", "tiddlygo", map[string]string{"Referer": "http://evil.example/login.html"}, http.StatusForbidden, false},
+		{"from a file", "tiddlygo", map[string]string{"Origin": "null"}, http.StatusForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"username": {"tiddlygo"}, "password": {test.password}, "next": {"/notes.html"}}
+
+			req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", rec.Code, test.status, rec.Body.String())
+			}
+
+			session := sessionOf(rec)
+
+			if session != nil {
+				for _, c := range rec.Result().Cookies() {
+					if c.Name == c_sessionCookie {
+						deleteSession(c.Value)
+					}
+				}
+			}
+
+			if (session != nil) != test.session {
+				t.Fatalf("session = %+v, want one: %v", session, test.session)
+			}
+
+			if test.session && rec.Header().Get("Location") != "/notes.html" {
+				t.Fatalf("location = %v, want the next page", rec.Header().Get("Location"))
+			}
+		})
+	}
+}
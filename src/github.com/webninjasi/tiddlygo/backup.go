@@ -0,0 +1,376 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const c_backupTimeFormat = "20060102T150405.000Z"
+
+type BackupConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Dir        string `json:"dir"`
+	KeepLast   int    `json:"keeplast"`
+	KeepDaily  int    `json:"keepdaily"`
+	KeepWeekly int    `json:"keepweekly"`
+	Compress   bool   `json:"compress"`
+}
+
+type Backup struct {
+	Id         string
+	Path       string
+	Time       time.Time
+	Size       int64
+	Compressed bool
+}
+
+func NewBackupConfig() BackupConfig {
+	return BackupConfig{
+		Enabled:    true,
+		Dir:        "",
+		KeepLast:   10,
+		KeepDaily:  7,
+		KeepWeekly: 4,
+		Compress:   true,
+	}
+}
+
+// backupDir returns the directory holding the backups of a wiki
+func backupDir(wikiname string) string {
+	dir := cfg().Backup.Dir
+	if dir == "" {
+		dir = filepath.Join(cfg().WikiDir, ".backups")
+	}
+
+	return filepath.Join(dir, strings.TrimSuffix(wikiname, ".html"))
+}
+
+// backupWiki keeps the current version of a wiki before it is overwritten
+func backupWiki(wikiname string) error {
+	if !cfg().Backup.Enabled {
+		return nil
+	}
+
+	if !isWiki(wikiname) {
+		return nil
+	}
+
+	// The store keeps every version itself
+	if _, ok := wikiStore().(HistoryStore); ok {
+		return nil
+	}
+
+	dir := backupDir(wikiname)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	id := time.Now().UTC().Format(c_backupTimeFormat)
+	backuppath := filepath.Join(dir, id+".html")
+
+	// A wiki file is replaced by a rename, so a hard link keeps the old content
+	if fs, ok := wikiStore().(*FileStore); ok {
+		if wikipath, single := fs.Path(wikiname); single {
+			if os.Link(wikipath, backuppath) == nil {
+				return nil
+			}
+
+			return copyFile(backuppath, wikipath)
+		}
+	}
+
+	content, err := readWiki(wikiname)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(backuppath, content, 0644)
+}
+
+// listBackups returns the backups of a wiki, newest first
+func listBackups(wikiname string) ([]Backup, error) {
+	dir := backupDir(wikiname)
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []Backup{}
+
+	for _, f := range files {
+		name := f.Name()
+		compressed := strings.HasSuffix(name, ".html.gz")
+
+		if !compressed && !strings.HasSuffix(name, ".html") {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".html")
+
+		t, err := time.Parse(c_backupTimeFormat, id)
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		size := f.Size()
+
+		if compressed {
+			size, err = gzipSize(path)
+			if err != nil {
+				continue
+			}
+		}
+
+		backups = append(backups, Backup{
+			Id:         id,
+			Path:       path,
+			Time:       t,
+			Size:       size,
+			Compressed: compressed,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// pruneBackups applies the retention policy and compresses old backups
+func pruneBackups(wikiname string) error {
+	backups, err := listBackups(wikiname)
+	if err != nil {
+		return err
+	}
+
+	keep := retainBackups(backups, cfg().Backup, time.Now())
+
+	for idx, backup := range backups {
+		if !keep[idx] {
+			err = os.Remove(backup.Path)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// The latest backup stays uncompressed since it is the most likely to be needed
+		if cfg().Backup.Compress && idx > 0 && !backup.Compressed {
+			err = compressFile(backup.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// retainBackups marks the backups to keep; backups must be sorted newest first.
+// The daily and weekly backups are the newest ones of each of the last days
+// and weeks before now, so older backups don't count against them.
+func retainBackups(backups []Backup, policy BackupConfig, now time.Time) []bool {
+	keep := make([]bool, len(backups))
+
+	for idx := range backups {
+		if idx < policy.KeepLast {
+			keep[idx] = true
+		}
+	}
+
+	now = now.Local()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	dailyCutoff := today.AddDate(0, 0, 1-policy.KeepDaily)
+
+	// ISO weeks start on Monday
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	weeklyCutoff := monday.AddDate(0, 0, 7*(1-policy.KeepWeekly))
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+
+	for idx, backup := range backups {
+		t := backup.Time.Local()
+
+		day := t.Format("2006-01-02")
+		if policy.KeepDaily > 0 && !t.Before(dailyCutoff) && !days[day] {
+			days[day] = true
+			keep[idx] = true
+		}
+
+		year, week := t.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+		if policy.KeepWeekly > 0 && !t.Before(weeklyCutoff) && !weeks[weekKey] {
+			weeks[weekKey] = true
+			keep[idx] = true
+		}
+	}
+
+	return keep
+}
+
+// handleBackup backs up a wiki before a store and logs any failure,
+// since a missing backup shouldn't prevent the wiki from being saved
+func handleBackup(wikiname string) {
+	err := backupWiki(wikiname)
+	if err != nil {
+		log.Printf("Warning: Couldn't back up '%v': %v\n", wikiname, err)
+	}
+}
+
+// handlePrune logs any failure while applying the retention policy
+func handlePrune(wikiname string) {
+	if !cfg().Backup.Enabled {
+		return
+	}
+
+	err := pruneBackups(wikiname)
+	if err != nil {
+		log.Printf("Warning: Couldn't prune backups of '%v': %v\n", wikiname, err)
+	}
+}
+
+func copyFile(dst string, src string) error {
+	inp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer inp.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, inp)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// gzipSize reads the uncompressed size from the trailer of a gzip file
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	trailer := make([]byte, 4)
+
+	_, err = f.ReadAt(trailer, fileSize(f)-4)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+func fileSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// compressFile replaces a file with its gzipped version
+func compressFile(path string) error {
+	inp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer inp.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+
+	_, err = io.Copy(zw, inp)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	inp.Close()
+
+	return os.Remove(path)
+}
+
+// findBackup returns the backup of a wiki with the given id
+func findBackup(wikiname string, id string) (Backup, error) {
+	backups, err := listBackups(wikiname)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	for _, backup := range backups {
+		if backup.Id == id {
+			return backup, nil
+		}
+	}
+
+	return Backup{}, os.ErrNotExist
+}
+
+// openBackup opens the content of a backup, decompressing it if needed
+func openBackup(backup Backup) (io.ReadCloser, error) {
+	f, err := os.Open(backup.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !backup.Compressed {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return gzipFile{zr, f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (this gzipFile) Close() error {
+	this.Reader.Close()
+	return this.f.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func backupsAt(times ...time.Time) []Backup {
+	backups := []Backup{}
+
+	for _, t := range times {
+		backups = append(backups, Backup{Id: t.Format(c_backupTimeFormat), Time: t})
+	}
+
+	return backups
+}
+
+func TestRetainBackups(t *testing.T) {
+	now := time.Date(2024, 6, 12, 15, 0, 0, 0, time.Local) // a Wednesday
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name    string
+		policy  BackupConfig
+		backups []Backup
+		keep    []bool
+	}{
+		{
+			name:    "last",
+			policy:  BackupConfig{KeepLast: 2},
+			backups: backupsAt(now, now.Add(-time.Hour), now.Add(-2*time.Hour)),
+			keep:    []bool{true, true, false},
+		},
+		{
+			name:   "newest of each day in the window",
+			policy: BackupConfig{KeepDaily: 2},
+			backups: backupsAt(
+				now.Add(-time.Hour),
+				now.Add(-2*time.Hour),
+				now.Add(-day),
+				now.Add(-day-time.Hour),
+				now.Add(-2*day),
+			),
+			keep: []bool{true, false, true, false, false},
+		},
+		{
+			// Months old backups aren't the "daily" ones of a wiki left alone
+			name:    "old days are outside the window",
+			policy:  BackupConfig{KeepDaily: 7},
+			backups: backupsAt(now.Add(-60*day), now.Add(-61*day), now.Add(-62*day)),
+			keep:    []bool{false, false, false},
+		},
+		{
+			name:   "newest of each week in the window",
+			policy: BackupConfig{KeepWeekly: 2},
+			backups: backupsAt(
+				now.Add(-time.Hour),
+				now.Add(-day),
+				now.Add(-7*day),
+				now.Add(-8*day),
+				now.Add(-14*day),
+			),
+			keep: []bool{true, false, true, false, false},
+		},
+		{
+			name:    "nothing but the last",
+			policy:  BackupConfig{KeepLast: 1},
+			backups: backupsAt(now.Add(-time.Hour), now.Add(-day), now.Add(-7*day)),
+			keep:    []bool{true, false, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep := retainBackups(test.backups, test.policy, now)
+
+			for idx := range keep {
+				if keep[idx] != test.keep[idx] {
+					t.Errorf("backup %v: keep = %v, want %v", test.backups[idx].Id, keep[idx], test.keep[idx])
+				}
+			}
+		})
+	}
+}
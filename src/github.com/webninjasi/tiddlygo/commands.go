@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+const c_usage = `Usage: tiddlygo [flags] [command]
+
+Commands:
+  serve           Start the server, the default (see tiddlygo serve -h)
+  tray            Show the tray icon, of a new or a running server
+  new             Create a wiki
+  list            List the wikis
+  backup          Back up the wikis
+  user            Manage the user accounts
+  check-config    Check the config and list every problem
+  print-config    Print the config with the environment and the flags applied
+
+The settings are taken from, each overriding the ones before it:
+  1. the defaults
+  2. the config file, --config or TIDDLYGO_CONFIG (tiddlygo.json by default)
+  3. the environment variables, e.g. TIDDLYGO_S3_BUCKET
+  4. the flags, e.g. --s3.bucket
+
+Flags:`
+
+const c_serveUsage = `Usage: tiddlygo [flags] serve [--headless]
+
+Starts the server, with its tray icon if one can be shown.
+
+  --headless   Only run the server, e.g. on a server or in a container`
+
+const c_trayUsage = `Usage: tiddlygo [flags] tray [--url url]
+
+Shows the tray icon of a server it starts, or of one which is already running.
+
+  --url url    The address of a running server, e.g. http://127.0.0.1:8080`
+
+const c_newUsage = `Usage: tiddlygo [flags] new [--title title] [--user name] <name> [template]
+
+Creates a wiki from a file of the template directory, or from the latest
+empty wiki of tiddlywiki.com if no template is given.
+
+  --title title   The title of the wiki
+  --user name     Who created the wiki, e.g. for the git commits`
+
+const c_listUsage = `Usage: tiddlygo [flags] list
+
+Lists the wikis with their sizes and the times they were last saved.`
+
+const c_backupUsage = `Usage: tiddlygo [flags] backup [name...]
+
+Backs up the wikis, all of them if none are given, and prunes their old
+backups by the retention policy.`
+
+var (
+	ErrNoTray         = errors.New("The tray icon can't be shown, it needs a display and a build with the tray tag!")
+	ErrBackupDisabled = errors.New("Backups are disabled, set backup.enabled to back up the wikis!")
+	ErrBackupHistory  = errors.New("The storage keeps every version of the wikis itself, there is nothing to back up!")
+)
+
+// commands are run by their name, which is the first arg after the flags
+var commands = map[string]func(args []string) error{
+	"serve":        serveCommand,
+	"tray":         trayCommand,
+	"new":          newCommand,
+	"list":         listCommand,
+	"backup":       backupCommand,
+	"user":         userCommand,
+	"print-config": printConfigCommand,
+}
+
+// parseCommandFlags parses the flags of a command,
+// its usage is returned for the invalid ones
+func parseCommandFlags(flags *flag.FlagSet, args []string, usage string) error {
+	flags.SetOutput(ioutil.Discard)
+
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return errors.New(usage)
+	}
+	if err != nil {
+		return fmt.Errorf("%v\n\n%v", err, usage)
+	}
+
+	return nil
+}
+
+// openWikiStore opens the storage of the config
+func openWikiStore() error {
+	store, err := newWikiStore(cfg())
+	if err != nil {
+		return fmt.Errorf("Error while opening the wiki storage: %v", err)
+	}
+
+	setWikiStore(store)
+	serverURL = toHttpAddr(cfg().Address, cfg().TLS.Enabled)
+
+	return nil
+}
+
+// startServer opens the storage and serves it in the background,
+// the config is reloaded whenever it changes
+func startServer() error {
+	err := cfg().Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid config file: %v", err)
+	}
+
+	evtHandler.Parse(cfg().Events)
+
+	err = openWikiStore()
+	if err != nil {
+		return err
+	}
+
+	router := getRouter()
+
+	go watchConfig()
+
+	go func() {
+		err := listen(router)
+		if err != nil {
+			log.Fatalln("Error while listening server:", err)
+		}
+	}()
+
+	return nil
+}
+
+// serveCommand runs the server, the tray icon is only a front end to it
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	headless := flags.Bool("headless", false, "")
+
+	err := parseCommandFlags(flags, args, c_serveUsage)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return errors.New(c_serveUsage)
+	}
+
+	if !*headless && !trayAvailable() {
+		log.Println("No tray icon can be shown, running headless")
+		*headless = true
+	}
+
+	err = startServer()
+	if err != nil {
+		return err
+	}
+
+	if !*headless {
+		runTray(serverURL)
+		return nil
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	log.Println("Stopping the server on", <-stop)
+
+	return nil
+}
+
+// trayCommand shows the tray icon, a server is only started if no url is given
+func trayCommand(args []string) error {
+	flags := flag.NewFlagSet("tray", flag.ContinueOnError)
+	url := flags.String("url", "", "")
+
+	err := parseCommandFlags(flags, args, c_trayUsage)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return errors.New(c_trayUsage)
+	}
+
+	if !trayAvailable() {
+		return ErrNoTray
+	}
+
+	if *url == "" {
+		err = startServer()
+		if err != nil {
+			return err
+		}
+
+		*url = serverURL
+	}
+
+	runTray(*url)
+
+	return nil
+}
+
+// newCommand creates a wiki like the new wiki form does
+func newCommand(args []string) error {
+	flags := flag.NewFlagSet("new", flag.ContinueOnError)
+	title := flags.String("title", "", "")
+	user := flags.String("user", cfg().Username, "")
+
+	err := parseCommandFlags(flags, args, c_newUsage)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New(c_newUsage)
+	}
+
+	wikiname := strings.TrimSuffix(flags.Arg(0), ".html")
+
+	match, err := regexp.MatchString(`^\w+$`, wikiname)
+	if !match || err != nil {
+		return errors.New("Invalid wiki name, it may only have letters, digits and underscores!")
+	}
+
+	wikiname = wikiname + ".html"
+
+	err = openWikiStore()
+	if err != nil {
+		return err
+	}
+
+	if isWiki(wikiname) {
+		return ErrWikiExists
+	}
+
+	wikitemplate := flags.Arg(1)
+
+	if wikitemplate == "" || wikitemplate == "Latest" {
+		err = downloadWiki(wikiname, "http://tiddlywiki.com/empty.html", *user)
+	} else {
+		err = renderTemplate(wikitemplate, wikiname, *title, *user)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created '%v'\n", wikiname)
+
+	return nil
+}
+
+// listCommand lists the wikis of the storage
+func listCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New(c_listUsage)
+	}
+
+	err := openWikiStore()
+	if err != nil {
+		return err
+	}
+
+	wikis, err := wikiStore().List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	for _, wiki := range wikis {
+		fmt.Fprintf(w, "%v\t%d\t%v\n", wiki.Name, wiki.Size, wiki.ModTime.Local().Format("2006-01-02 15:04:05"))
+	}
+
+	return w.Flush()
+}
+
+// backupCommand backs up the wikis now, e.g. from cron
+func backupCommand(args []string) error {
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		return errors.New(c_backupUsage)
+	}
+
+	if !cfg().Backup.Enabled {
+		return ErrBackupDisabled
+	}
+
+	err := openWikiStore()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := wikiStore().(HistoryStore); ok {
+		return ErrBackupHistory
+	}
+
+	wikinames := args
+
+	if len(wikinames) == 0 {
+		wikis, err := wikiStore().List()
+		if err != nil {
+			return err
+		}
+
+		for _, wiki := range wikis {
+			wikinames = append(wikinames, wiki.Name)
+		}
+	}
+
+	for _, wikiname := range wikinames {
+		if !strings.HasSuffix(wikiname, ".html") {
+			wikiname += ".html"
+		}
+
+		match, err := regexp.MatchString(`^\w+\.html$`, wikiname)
+		if !match || err != nil || !isWiki(wikiname) {
+			return fmt.Errorf("There is no wiki named '%v'!", wikiname)
+		}
+
+		err = backupWiki(wikiname)
+		if err != nil {
+			return err
+		}
+
+		err = pruneBackups(wikiname)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Backed up '%v'\n", wikiname)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const c_envTestArgs = "TEST_TIDDLYGO_ARGS"
+
+// runMainInTest runs main instead of the test when it's started by runMain
+func runMainInTest() {
+	if args := os.Getenv(c_envTestArgs); args != "" {
+		os.Args = append([]string{"tiddlygo"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+}
+
+// runMain runs tiddlygo with the args in another process, which is the named
+// test calling runMainInTest, and returns its exit status and output
+func runMain(t *testing.T, test string, args []string) (int, string) {
+	cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$")
+	cmd.Env = append(os.Environ(), c_envTestArgs+"="+strings.Join(args, "\n"))
+
+	output, err := cmd.CombinedOutput()
+
+	status := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, string(output)
+}
+
+func TestParseCommandFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		title string
+		rest  string
+		err   string
+	}{
+		{"no flags", []string{"notes"}, "", "notes", ""},
+		{"flag", []string{"--title", "My Notes", "notes", "empty.html"}, "My Notes", "notes empty.html", ""},
+		{"flag with a value", []string{"-title=My Notes", "notes"}, "My Notes", "notes", ""},
+		{"flags end", []string{"--", "--title"}, "", "--title", ""},
+		{"flags after args", []string{"notes", "--title", "x"}, "", "notes --title x", ""},
+		{"help", []string{"-h"}, "", "", "Usage: test"},
+		{"unknown flag", []string{"--tilte", "x"}, "", "", "flag provided but not defined: -tilte\n\nUsage: test"},
+		{"missing value", []string{"--title"}, "", "", "flag needs an argument: -title\n\nUsage: test"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			title := flags.String("title", "", "")
+
+			err := parseCommandFlags(flags, test.args, "Usage: test")
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got %v, want %q", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *title != test.title || strings.Join(flags.Args(), " ") != test.rest {
+				t.Fatalf("title = %q, args = %q", *title, flags.Args())
+			}
+		})
+	}
+}
+
+// TestCommands runs the commands in another process, so their exit
+// status and output can be checked
+func TestCommands(t *testing.T) {
+	runMainInTest()
+
+	config := useConfigFile(t, "tiddlygo.json", testConfig(t, map[string]interface{}{
+		"userfile": filepath.Join(t.TempDir(), "users.json"),
+	}))
+
+	template := filepath.Base(c_testTemplate)
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		output string
+	}{
+		{"unknown command", []string{"serv"}, 2, "Unknown command: serv\nUsage: tiddlygo [flags] [command]"},
+		{"help", []string{"-h"}, 0, "Usage: tiddlygo [flags] [command]"},
+		{"command help", []string{"new", "-h"}, 1, "Usage: tiddlygo [flags] new"},
+		{"unknown flag of a command", []string{"serve", "--headles"}, 1, "flag provided but not defined: -headles"},
+		{"args of serve", []string{"serve", "now"}, 1, "Usage: tiddlygo [flags] serve"},
+		{"args of tray", []string{"tray", "--url", "http://127.0.0.1:8080", "now"}, 1, "Usage: tiddlygo [flags] tray"},
+		{"new without a name", []string{"new"}, 1, "Usage: tiddlygo [flags] new"},
+		{"new with a bad name", []string{"new", "my-notes"}, 1, "Invalid wiki name"},
+		{"new", []string{"new", "--title", "My Notes", "notes.html", template}, 0, "Created 'notes.html'"},
+		{"new again", []string{"new", "notes", template}, 1, ErrWikiExists.Error()},
+		{"new from a missing template", []string{"new", "other", "missing.html"}, 1, "missing.html"},
+		{"list", []string{"list"}, 0, "notes.html"},
+		{"args of list", []string{"list", "notes"}, 1, "Usage: tiddlygo [flags] list"},
+		{"backup", []string{"backup"}, 0, "Backed up 'notes.html'"},
+		{"backup of a missing wiki", []string{"backup", "other"}, 1, "There is no wiki named 'other.html'!"},
+		{"backup disabled", []string{"--backup.enabled=false", "backup"}, 1, ErrBackupDisabled.Error()},
+		{"user", []string{"user", "list"}, 0, ""},
+		{"args of user", []string{"user", "add"}, 1, "Usage: tiddlygo user"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, output := runMain(t, "TestCommands", append([]string{"--config", config}, test.args...))
+
+			if status != test.status {
+				t.Fatalf("exit status = %v, want %v:\n%s", status, test.status, output)
+			}
+
+			if !strings.Contains(output, test.output) {
+				t.Fatalf("the output doesn't have %q:\n%s", test.output, output)
+			}
+		})
+	}
+
+	// The tray can't be shown without the tray tag
+	if !trayAvailable() {
+		status, output := runMain(t, "TestCommands", []string{"--config", config, "tray"})
+
+		if status != 1 || !strings.Contains(output, ErrNoTray.Error()) {
+			t.Fatalf("tray: exit status = %v:\n%s", status, output)
+		}
+	}
+}
@@ -2,40 +2,89 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"reflect"
+	"sync"
 )
 
 type Config struct {
-	Address     string   `json:"address"`
-	WikiDir     string   `json:"wikidir"`
-	TemplateDir string   `json:"templatedir"`
-	PublicDir   string   `json:"publicdir"`
-	Username    string   `json:"username"`
-	Password    string   `json:"password"`
-	Events      EventMap `json:"events"`
+	Address        string        `json:"address"`
+	TLS            TLSConfig     `json:"tls"`
+	WikiDir        string        `json:"wikidir"`
+	TemplateDir    string        `json:"templatedir"`
+	PublicDir      string        `json:"publicdir"`
+	Username       string        `json:"username"`
+	Password       string        `json:"password"`
+	UserFile       string        `json:"userfile"`
+	ACLFile        string        `json:"aclfile"`
+	TokenFile      string        `json:"tokenfile"`
+	Session        SessionConfig `json:"session"`
+	OIDC           OIDCConfig    `json:"oidc"`
+	Events         EventMap      `json:"events"`
+	ForceOverwrite bool          `json:"forceoverwrite"`
+	Storage        string        `json:"storage"`
+	S3             S3Config      `json:"s3"`
+	Database       string        `json:"database"`
+	Backup         BackupConfig  `json:"backup"`
+	Git            GitConfig     `json:"git"`
 }
 
-func (cfg *Config) ReadFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
+// The config is replaced as a whole when the config file is reloaded
+var currentConfig = NewConfig()
+var configLock sync.RWMutex
+
+// cfg returns the current config, which must not be changed in place
+func cfg() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	return currentConfig
+}
+
+func setConfig(conf *Config) {
+	configLock.Lock()
+	currentConfig = conf
+	configLock.Unlock()
+}
+
+// ReadTree reads the settings of the config file's JSON values. Unknown keys
+// and values of the wrong type are returned as ConfigErrors, the other values
+// are read anyway.
+func (cfg *Config) ReadTree(tree map[string]interface{}) error {
+	errs := ConfigErrors{}
+	checkJSONKeys("", tree, reflect.TypeOf(cfg).Elem(), &errs)
+
+	data, err := json.Marshal(tree)
 	if err != nil {
 		return err
 	}
 
-	if err := json.Unmarshal(data, cfg); err != nil {
+	if err := json.Unmarshal(data, cfg); err != nil && len(errs) == 0 {
 		return err
 	}
 
-	return nil
+	return errs.Err()
 }
 
 func NewConfig() *Config {
 	return &Config{
-		Address:     ":8080",
-		WikiDir:     "wikidir",
-		TemplateDir: "templates",
-		PublicDir:   "www",
-		Username:    "tiddlygo",
-		Password:    "tiddlygo",
-		Events:      EventMap{},
+		Address:        ":8080",
+		TLS:            NewTLSConfig(),
+		WikiDir:        "wikidir",
+		TemplateDir:    "templates",
+		PublicDir:      "www",
+		Username:       "tiddlygo",
+		Password:       "tiddlygo",
+		UserFile:       "users.json",
+		ACLFile:        "acl.json",
+		TokenFile:      "tokens.json",
+		Session:        NewSessionConfig(),
+		OIDC:           NewOIDCConfig(),
+		Events:         EventMap{},
+		ForceOverwrite: false,
+		Storage:        c_storageFile,
+		S3:             NewS3Config(),
+		Database:       "tiddlygo.db",
+		Backup:         NewBackupConfig(),
+		Git:            NewGitConfig(),
 	}
 }
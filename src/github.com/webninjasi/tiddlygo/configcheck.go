@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const c_checkConfigUsage = `Usage: tiddlygo [flags] check-config [file]
+
+Checks the config file (tiddlygo.json by default) with the environment
+variables and the flags applied, and lists every problem.`
+
+// ConfigError is a problem of the config at a JSON path, e.g. "events.poststore[0][1]"
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+// ConfigErrors are all the problems found in a config
+type ConfigErrors []ConfigError
+
+func (this ConfigError) Error() string {
+	if this.Path == "" {
+		return this.Message
+	}
+
+	return this.Path + ": " + this.Message
+}
+
+func (this ConfigErrors) Error() string {
+	if len(this) == 1 {
+		return this[0].Error()
+	}
+
+	lines := []string{fmt.Sprintf("%d problems:", len(this))}
+
+	for _, err := range this {
+		lines = append(lines, "\t"+err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (this *ConfigErrors) Add(path string, format string, args ...interface{}) {
+	*this = append(*this, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Sort orders the errors by their paths
+func (this ConfigErrors) Sort() {
+	sort.SliceStable(this, func(i, j int) bool {
+		return this[i].Path < this[j].Path
+	})
+}
+
+// Err returns the errors as an error, or nil if there are none
+func (this ConfigErrors) Err() error {
+	if len(this) == 0 {
+		return nil
+	}
+
+	return this
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+
+	for key := range obj {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// jsonSyntaxError tells where the JSON of the config is broken
+func jsonSyntaxError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err
+	}
+
+	line, col := 1, 1
+
+	for _, c := range data[:syntaxErr.Offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+
+	return ConfigErrors{{Message: fmt.Sprintf("line %d, column %d: %v", line, col, err)}}
+}
+
+// checkJSONKeys reports the keys which aren't in the config and the values
+// of the wrong type. Keys are matched like encoding/json does, ignoring the case.
+func checkJSONKeys(path string, value interface{}, t reflect.Type, errs *ConfigErrors) {
+	if value == nil {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.Add(path, "must be an object")
+			return
+		}
+
+		fields := map[string]reflect.Type{}
+
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name != "" && name != "-" {
+				fields[strings.ToLower(name)] = t.Field(i).Type
+			}
+		}
+
+		for _, key := range sortedKeys(obj) {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				errs.Add(joinPath(path, key), "unknown key")
+				continue
+			}
+
+			checkJSONKeys(joinPath(path, key), obj[key], fieldType, errs)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.Add(path, "must be an object")
+			return
+		}
+
+		for _, key := range sortedKeys(obj) {
+			checkJSONKeys(joinPath(path, key), obj[key], t.Elem(), errs)
+		}
+	case reflect.Slice:
+		arr, ok := value.([]interface{})
+		if !ok {
+			errs.Add(path, "must be an array")
+			return
+		}
+
+		for i, v := range arr {
+			checkJSONKeys(fmt.Sprintf("%v[%d]", path, i), v, t.Elem(), errs)
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			errs.Add(path, "must be a string")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			errs.Add(path, "must be true or false")
+		}
+	case reflect.Int:
+		if num, ok := value.(float64); !ok || num != float64(int(num)) {
+			errs.Add(path, "must be a whole number")
+		}
+	}
+}
+
+// Validate checks the values of the config, every problem is reported
+// with its JSON path
+func (cfg *Config) Validate() error {
+	errs := ConfigErrors{}
+
+	checkAddress(&errs, "address", cfg.Address)
+
+	checkDir(&errs, "templatedir", cfg.TemplateDir, true)
+	checkDir(&errs, "publicdir", cfg.PublicDir, true)
+
+	switch cfg.Storage {
+	case c_storageFile, c_storageTiddlers:
+		// The wiki directory is made when it's needed
+		checkDir(&errs, "wikidir", cfg.WikiDir, false)
+	case c_storageS3:
+		if cfg.S3.Bucket == "" {
+			errs.Add("s3.bucket", "is needed for the s3 storage")
+		}
+
+		if cfg.S3.Endpoint == "" {
+			errs.Add("s3.endpoint", "can't be empty")
+		}
+	case c_storageSQLite:
+		if cfg.Database == "" {
+			errs.Add("database", "is needed for the sqlite storage")
+		}
+	default:
+		errs.Add("storage", "unknown storage %q, the storages are file, tiddlers, s3 and sqlite", cfg.Storage)
+	}
+
+	checkDuration(&errs, "session.lifetime", cfg.Session.Lifetime, true)
+
+	if cfg.TLS.Enabled {
+		if !cfg.TLS.SelfSigned {
+			checkFile(&errs, "tls.certfile", cfg.TLS.CertFile)
+			checkFile(&errs, "tls.keyfile", cfg.TLS.KeyFile)
+		}
+
+		if cfg.TLS.RedirectAddress != "" {
+			checkAddress(&errs, "tls.redirectaddress", cfg.TLS.RedirectAddress)
+		}
+
+		checkDuration(&errs, "tls.hsts", cfg.TLS.HSTS, false)
+	}
+
+	if cfg.OIDC.Issuer != "" || cfg.OIDC.ClientID != "" {
+		issuer, err := url.Parse(cfg.OIDC.Issuer)
+		if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+			errs.Add("oidc.issuer", "must be the http(s) URL of the provider")
+		}
+
+		if cfg.OIDC.ClientID == "" {
+			errs.Add("oidc.clientid", "is needed with an issuer")
+		}
+
+		if cfg.OIDC.UserClaim == "" {
+			errs.Add("oidc.userclaim", "can't be empty")
+		}
+	}
+
+	if cfg.Backup.Dir != "" {
+		checkDir(&errs, "backup.dir", cfg.Backup.Dir, false)
+	}
+
+	// The backups are files on the disk, they shouldn't end up in the
+	// wiki directory which the s3 storage doesn't use
+	if cfg.Storage == c_storageS3 && cfg.Backup.Enabled && cfg.Backup.Dir == "" {
+		errs.Add("backup.dir", "is needed for the backups of the s3 storage, which are kept on the disk, or backup.enabled must be false")
+	}
+
+	for key, value := range map[string]int{
+		"backup.keeplast":   cfg.Backup.KeepLast,
+		"backup.keepdaily":  cfg.Backup.KeepDaily,
+		"backup.keepweekly": cfg.Backup.KeepWeekly,
+		"git.retries":       cfg.Git.Retries,
+	} {
+		if value < 0 {
+			errs.Add(key, "can't be negative")
+		}
+	}
+
+	for key, text := range map[string]string{
+		"git.message": cfg.Git.Message,
+		"git.email":   cfg.Git.Email,
+	} {
+		if _, err := template.New("git").Parse(text); err != nil {
+			errs.Add(key, "invalid template: %v", err)
+		}
+	}
+
+	checkEvents(&errs, cfg.Events)
+
+	errs.Sort()
+
+	return errs.Err()
+}
+
+func checkAddress(errs *ConfigErrors, path string, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.Add(path, "invalid address %q, it should look like :8080 or 127.0.0.1:8080", addr)
+		return
+	}
+
+	if port == "" {
+		errs.Add(path, "the address %q has no port", addr)
+		return
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		errs.Add(path, "invalid port %q", port)
+	}
+}
+
+// checkDir reports a path which isn't a directory, or doesn't exist if it must
+func checkDir(errs *ConfigErrors, path string, dir string, mustExist bool) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if mustExist {
+			errs.Add(path, "the directory %q doesn't exist", dir)
+		}
+
+		return
+	}
+	if err != nil {
+		errs.Add(path, "%v", err)
+		return
+	}
+
+	if !info.IsDir() {
+		errs.Add(path, "%q isn't a directory", dir)
+	}
+}
+
+func checkFile(errs *ConfigErrors, path string, filename string) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		errs.Add(path, "the file %q doesn't exist", filename)
+		return
+	}
+	if err != nil {
+		errs.Add(path, "%v", err)
+		return
+	}
+
+	if info.IsDir() {
+		errs.Add(path, "%q is a directory", filename)
+	}
+}
+
+func checkDuration(errs *ConfigErrors, path string, value string, required bool) {
+	if value == "" && !required {
+		return
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		errs.Add(path, "invalid duration %q, it should look like 12h or 30m", value)
+	}
+}
+
+// checkEvents reports the unknown events, the malformed actions and
+// the placeholders which aren't args of their event
+func checkEvents(errs *ConfigErrors, events EventMap) {
+	names := make([]string, 0, len(events))
+
+	for name := range events {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := joinPath("events", name)
+
+		argc, ok := eventArgs[strings.ToLower(name)]
+		if !ok {
+			errs.Add(path, "unknown event, the events are prestore and poststore")
+			continue
+		}
+
+		if len(events[name]) == 0 {
+			errs.Add(path, "has no actions")
+			continue
+		}
+
+		for i, action := range events[name] {
+			actionPath := fmt.Sprintf("%v[%d]", path, i)
+
+			if len(action) == 0 {
+				errs.Add(actionPath, `empty action, it should look like ["git", "add"]`)
+				continue
+			}
+
+			switch strings.ToLower(action[0]) {
+			case "cmd":
+				if len(action) < 2 {
+					errs.Add(actionPath, "cmd needs a command to run")
+				}
+			case "git":
+				if len(action) < 2 {
+					errs.Add(actionPath, "git needs a command, one of %v", strings.Join(gitActionCommands, ", "))
+				} else if !isGitActionCommand(action[1]) {
+					errs.Add(actionPath+"[1]", "unknown git command %q, the commands are %v",
+						action[1], strings.Join(gitActionCommands, ", "))
+				}
+			default:
+				errs.Add(actionPath+"[0]", "unknown action %q, the actions are cmd and git", action[0])
+				continue
+			}
+
+			for j, arg := range action[1:] {
+				if !strings.HasPrefix(arg, "$") || len(arg) < 2 {
+					continue
+				}
+
+				num, err := strconv.Atoi(arg[1:])
+				if err == nil && (num < 0 || num >= argc) {
+					errs.Add(fmt.Sprintf("%v[%d]", actionPath, j+1),
+						"%v is out of range, %v has the args $0 to $%d", arg, name, argc-1)
+				}
+			}
+		}
+	}
+}
+
+// checkConfigCommand reads a config file and lists all of its problems
+func checkConfigCommand(args []string) error {
+	if len(args) > 1 {
+		return errors.New(c_checkConfigUsage)
+	}
+
+	if len(args) == 1 {
+		configFile, configFileGiven = args[0], true
+	}
+
+	filename := configFile
+
+	// The values which could be read are checked even if some couldn't
+	errs := ConfigErrors{}
+
+	conf, err := loadConfig()
+	if readErrs, ok := err.(ConfigErrors); ok && len(readErrs) > 0 && readErrs[0].Path != "" {
+		errs = append(errs, readErrs...)
+	} else if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	if validateErrs, ok := conf.Validate().(ConfigErrors); ok {
+		errs = append(errs, validateErrs...)
+	}
+
+	if len(errs) > 0 {
+		errs.Sort()
+		return fmt.Errorf("%v: %v", filename, errs)
+	}
+
+	fmt.Printf("%v: OK\n", filename)
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useConfigFile writes a config file and reads the config from it like the
+// commands do, without any environment variables or flags
+func useConfigFile(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldFile, oldGiven, oldOverrides := configFile, configFileGiven, configOverrides
+
+	t.Cleanup(func() {
+		configFile, configFileGiven, configOverrides = oldFile, oldGiven, oldOverrides
+	})
+
+	configFile, configFileGiven, configOverrides = filename, true, []ConfigOverride{}
+
+	return filename
+}
+
+// testConfig returns a valid config with the settings changed over it
+func testConfig(t *testing.T, settings map[string]interface{}) string {
+	conf := map[string]interface{}{
+		"templatedir": "../../../../templates",
+		"publicdir":   "../../../../www",
+		"wikidir":     filepath.Join(t.TempDir(), "wikis"),
+	}
+
+	for key, value := range settings {
+		conf[key] = value
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// configErrorPaths returns the paths of the problems check-config reports
+func configErrorPaths(t *testing.T) []string {
+	errs := ConfigErrors{}
+
+	conf, err := loadConfig()
+	if readErrs, ok := err.(ConfigErrors); ok {
+		errs = append(errs, readErrs...)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if validateErrs, ok := conf.Validate().(ConfigErrors); ok {
+		errs = append(errs, validateErrs...)
+	}
+
+	errs.Sort()
+
+	paths := []string{}
+	for _, err := range errs {
+		paths = append(paths, err.Path)
+	}
+
+	return paths
+}
+
+func TestValidateConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+
+	err := ioutil.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		paths    string
+	}{
+		{"valid", nil, ""},
+		{"unknown keys", map[string]interface{}{
+			"adress": ":8080",
+			"backup": map[string]interface{}{"keeplast": 1, "keepforever": true},
+		}, "adress,backup.keepforever"},
+		{"keys in another case", map[string]interface{}{
+			"Address": ":8081",
+			"Backup":  map[string]interface{}{"KeepLast": 1},
+		}, ""},
+		{"wrong types", map[string]interface{}{
+			"address": 8080,
+			"backup":  map[string]interface{}{"keeplast": 1.5, "enabled": "yes"},
+			"session": "1h",
+		}, "address,backup.enabled,backup.keeplast,session"},
+		{"address without a host", map[string]interface{}{"address": "8080"}, "address"},
+		{"address without a port", map[string]interface{}{"address": "localhost:"}, "address"},
+		{"address with a bad port", map[string]interface{}{"address": ":99999"}, "address"},
+		{"missing dirs", map[string]interface{}{
+			"templatedir": "missing",
+			"publicdir":   file,
+			"wikidir":     file,
+		}, "publicdir,templatedir,wikidir"},
+		{"missing wikidir", map[string]interface{}{"wikidir": filepath.Join(t.TempDir(), "missing")}, ""},
+		{"bad durations", map[string]interface{}{
+			"session": map[string]interface{}{"lifetime": "forever"},
+			"tls":     map[string]interface{}{"enabled": true, "selfsigned": true, "hsts": "-1h"},
+		}, "session.lifetime,tls.hsts"},
+		{"missing certificate", map[string]interface{}{
+			"tls": map[string]interface{}{"enabled": true, "certfile": file, "keyfile": "missing.key"},
+		}, "tls.keyfile"},
+		{"unknown storage", map[string]interface{}{"storage": "ftp"}, "storage"},
+		{"s3 without a bucket", map[string]interface{}{
+			"storage": "s3",
+			"s3":      map[string]interface{}{"endpoint": ""},
+		}, "backup.dir,s3.bucket,s3.endpoint"},
+		{"negative numbers", map[string]interface{}{
+			"backup": map[string]interface{}{"keepdaily": -1},
+			"git":    map[string]interface{}{"retries": -1},
+		}, "backup.keepdaily,git.retries"},
+		{"bad template", map[string]interface{}{
+			"git": map[string]interface{}{"message": "{{.Wiki"},
+		}, "git.message"},
+		{"oidc without a client", map[string]interface{}{
+			"oidc": map[string]interface{}{"issuer": "accounts.example.com"},
+		}, "oidc.clientid,oidc.issuer"},
+		{"unknown event", map[string]interface{}{
+			"events": map[string]interface{}{"prestart": [][]string{{"git", "add", "$1"}}},
+		}, "events.prestart"},
+		{"event without actions", map[string]interface{}{
+			"events": map[string]interface{}{"poststore": [][]string{}},
+		}, "events.poststore"},
+		{"empty action", map[string]interface{}{
+			"events": map[string]interface{}{"poststore": [][]string{{"git", "add", "$1"}, {}}},
+		}, "events.poststore[1]"},
+		{"unknown actions", map[string]interface{}{
+			"events": map[string]interface{}{"poststore": [][]string{{"run", "echo"}, {"git", "merge"}, {"git"}, {"cmd"}}},
+		}, "events.poststore[0][0],events.poststore[1][1],events.poststore[2],events.poststore[3]"},
+		{"args out of range", map[string]interface{}{
+			"events": map[string]interface{}{
+				"prestore":  [][]string{{"cmd", "echo", "$0", "$1", "$2"}},
+				"poststore": [][]string{{"git", "commit", "$1", "$-1", "$user"}},
+			},
+		}, "events.poststore[0][3],events.prestore[0][4]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useConfigFile(t, "tiddlygo.json", testConfig(t, test.settings))
+
+			if paths := strings.Join(configErrorPaths(t), ","); paths != test.paths {
+				t.Fatalf("problems at %q, want %q", paths, test.paths)
+			}
+		})
+	}
+}
+
+func TestConfigSyntaxError(t *testing.T) {
+	useConfigFile(t, "tiddlygo.json", "{\n\t\"address\": \":8080\",\n}")
+
+	_, err := loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "line 3, column 2") {
+		t.Fatalf("got %v, want the line and column of the problem", err)
+	}
+}
+
+// TestCheckConfigExit runs check-config in another process, so its exit
+// status can be checked
+func TestCheckConfigExit(t *testing.T) {
+	runMainInTest()
+
+	valid := useConfigFile(t, "valid.json", testConfig(t, nil))
+	invalid := useConfigFile(t, "invalid.json", testConfig(t, map[string]interface{}{
+		"address": "8080",
+		"session": map[string]interface{}{"lifetime": "forever"},
+	}))
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		output string
+	}{
+		{"valid config", []string{"check-config", valid}, 0, "valid.json: OK"},
+		{"invalid config", []string{"check-config", invalid}, 1, "2 problems"},
+		{"config given with a flag", []string{"--config", invalid, "check-config"}, 1, "session.lifetime"},
+		{"missing config", []string{"check-config", filepath.Join(t.TempDir(), "missing.json")}, 1, "missing.json"},
+		{"too many args", []string{"check-config", valid, invalid}, 1, "Usage: tiddlygo [flags] check-config"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, output := runMain(t, "TestCheckConfigExit", test.args)
+
+			if status != test.status {
+				t.Fatalf("exit status = %v, want %v:\n%s", status, test.status, output)
+			}
+
+			if !strings.Contains(output, test.output) {
+				t.Fatalf("the output doesn't have %q:\n%s", test.output, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting can be given with an environment variable named after its
+// path, e.g. TIDDLYGO_S3_BUCKET for s3.bucket
+const c_envPrefix = "TIDDLYGO_"
+const c_envConfigFile = c_envPrefix + "CONFIG"
+
+const c_printConfigUsage = `Usage: tiddlygo [flags] print-config
+
+Prints the config after the environment variables and the flags are applied,
+the secrets are hidden.`
+
+// The config file to read, a file which was given explicitly must exist
+var configFile = c_configFile
+var configFileGiven = false
+
+// The settings given outside the config file, in the order they're applied
+var configOverrides = []ConfigOverride{}
+
+// ConfigOverride is a setting from an environment variable or a flag,
+// it's applied over the config file whenever the file is read
+type ConfigOverride struct {
+	Source string
+	Path   string
+	Value  string
+}
+
+// configFlag is the value of a setting's flag, flags of bool settings
+// can be given without a value
+type configFlag struct {
+	value  string
+	isBool bool
+}
+
+func (this *configFlag) String() string {
+	if this == nil {
+		return ""
+	}
+
+	return this.value
+}
+
+func (this *configFlag) Set(value string) error {
+	this.value = value
+	return nil
+}
+
+func (this *configFlag) IsBoolFlag() bool {
+	return this.isBool
+}
+
+// configFields returns the types of the settings by their dotted paths, e.g.
+// "backup.keeplast". Maps and lists are single settings given as JSON.
+func configFields(path string, t reflect.Type, fields map[string]reflect.Type, paths *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldPath := joinPath(path, name)
+		fieldType := t.Field(i).Type
+
+		if fieldType.Kind() == reflect.Struct {
+			configFields(fieldPath, fieldType, fields, paths)
+			continue
+		}
+
+		fields[fieldPath] = fieldType
+		*paths = append(*paths, fieldPath)
+	}
+}
+
+func envName(path string) string {
+	return c_envPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// parseFlags reads the config file's path and the settings of the environment
+// variables and the flags, and returns the args after the flags
+func parseFlags(args []string) ([]string, error) {
+	fields := map[string]reflect.Type{}
+	paths := []string{}
+	configFields("", reflect.TypeOf(Config{}), fields, &paths)
+
+	flags := flag.NewFlagSet("tiddlygo", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), c_usage)
+		flags.PrintDefaults()
+	}
+
+	filename := flags.String("config", "", "The config file, JSON, YAML or TOML by its extension (env "+c_envConfigFile+")")
+
+	values := map[string]*configFlag{}
+
+	for _, path := range paths {
+		value := &configFlag{isBool: fields[path].Kind() == reflect.Bool}
+		values[path] = value
+
+		flags.Var(value, path, "Sets "+path+" (env "+envName(path)+")")
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, configFileGiven = c_configFile, false
+
+	if env, ok := os.LookupEnv(c_envConfigFile); ok && env != "" {
+		configFile, configFileGiven = env, true
+	}
+
+	if *filename != "" {
+		configFile, configFileGiven = *filename, true
+	}
+
+	configOverrides = []ConfigOverride{}
+
+	for _, path := range paths {
+		if value, ok := os.LookupEnv(envName(path)); ok {
+			configOverrides = append(configOverrides, ConfigOverride{envName(path), path, value})
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := values[f.Name]; ok {
+			configOverrides = append(configOverrides, ConfigOverride{"--" + f.Name, f.Name, value.value})
+		}
+	})
+
+	return flags.Args(), nil
+}
+
+// parse converts the text of the setting to the JSON value of its type.
+// Lists of strings can also be given separated by commas.
+func (this ConfigOverride) parse(t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return this.Value, nil
+	case reflect.Bool:
+		value, err := strconv.ParseBool(this.Value)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+
+		return value, nil
+	case reflect.Int:
+		value, err := strconv.Atoi(this.Value)
+		if err != nil {
+			return nil, errors.New("must be a whole number")
+		}
+
+		return float64(value), nil
+	}
+
+	text := strings.TrimSpace(this.Value)
+
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String && !strings.HasPrefix(text, "[") {
+		list := []interface{}{}
+
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+
+		return list, nil
+	}
+
+	var value interface{}
+
+	err := json.Unmarshal([]byte(text), &value)
+	if err != nil {
+		return nil, fmt.Errorf("must be JSON: %v", err)
+	}
+
+	return value, nil
+}
+
+// readConfigTree reads the config file into JSON values, the format is
+// chosen by the extension and anything else is read as JSON
+func readConfigTree(filename string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, jsonSyntaxError(data, err)
+		}
+	}
+
+	if err != nil {
+		return nil, ConfigErrors{{Message: err.Error()}}
+	}
+
+	if raw == nil {
+		// An empty YAML file
+		return map[string]interface{}{}, nil
+	}
+
+	// Make the YAML and TOML values look like JSON ones, e.g. numbers are float64
+	data, err = json.Marshal(jsonValue(raw))
+	if err != nil {
+		return nil, ConfigErrors{{Message: err.Error()}}
+	}
+
+	var tree interface{}
+
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := tree.(map[string]interface{})
+	if !ok {
+		return nil, ConfigErrors{{Message: "the config must be an object"}}
+	}
+
+	return obj, nil
+}
+
+// jsonValue converts the maps with non-string keys YAML may give
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonValue(item)
+		}
+	case map[interface{}]interface{}:
+		obj := map[string]interface{}{}
+
+		for key, item := range v {
+			obj[fmt.Sprint(key)] = jsonValue(item)
+		}
+
+		return obj
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+	}
+
+	return value
+}
+
+// setTreeValue sets the value at a dotted path, replacing the keys
+// which only differ in case like encoding/json would match them
+func setTreeValue(tree map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+
+	for _, key := range keys[:len(keys)-1] {
+		var next map[string]interface{}
+
+		for name, item := range tree {
+			if strings.EqualFold(name, key) {
+				if obj, ok := item.(map[string]interface{}); ok {
+					next = obj
+				}
+
+				delete(tree, name)
+			}
+		}
+
+		if next == nil {
+			next = map[string]interface{}{}
+		}
+
+		tree[key] = next
+		tree = next
+	}
+
+	last := keys[len(keys)-1]
+
+	for name := range tree {
+		if strings.EqualFold(name, last) {
+			delete(tree, name)
+		}
+	}
+
+	tree[last] = value
+}
+
+// loadConfig reads the config file and applies the environment variables and
+// the flags over it. A missing file is only an error if it was given explicitly.
+// Like ReadTree, the settings which can't be used are returned as ConfigErrors
+// and the others are read anyway.
+func loadConfig() (*Config, error) {
+	conf := NewConfig()
+
+	tree, err := readConfigTree(configFile)
+	if os.IsNotExist(err) && !configFileGiven {
+		tree, err = map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return conf, err
+	}
+
+	fields := map[string]reflect.Type{}
+	configFields("", reflect.TypeOf(Config{}), fields, &[]string{})
+
+	errs := ConfigErrors{}
+
+	for _, override := range configOverrides {
+		value, err := override.parse(fields[override.Path])
+		if err != nil {
+			errs.Add(override.Source, "%v", err)
+			continue
+		}
+
+		setTreeValue(tree, override.Path, value)
+	}
+
+	err = conf.ReadTree(tree)
+	if readErrs, ok := err.(ConfigErrors); ok {
+		errs = append(errs, readErrs...)
+	} else if err != nil {
+		return conf, err
+	}
+
+	return conf, errs.Err()
+}
+
+// Redacted returns a copy of the config without the values of its secrets
+func (cfg *Config) Redacted() *Config {
+	conf := *cfg
+
+	for _, secret := range []*string{
+		&conf.Password,
+		&conf.S3.AccessKey,
+		&conf.S3.SecretKey,
+		&conf.OIDC.ClientSecret,
+		&conf.Git.RemotePassword,
+	} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+
+	conf.Git.Remote = redactURL(conf.Git.Remote)
+
+	return &conf
+}
+
+// printConfigCommand prints the config the server would use
+func printConfigCommand(args []string) error {
+	if len(args) > 0 {
+		return errors.New(c_printConfigUsage)
+	}
+
+	data, err := json.MarshalIndent(cfg().Redacted(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
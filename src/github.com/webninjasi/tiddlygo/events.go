@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync"
 )
 
 var (
@@ -12,17 +13,26 @@ var (
 	ErrInvalidEventActionType = errors.New("Invalid event action type!")
 )
 
+// The number of args each event gives to its actions, e.g. $0 and $1
+var eventArgs = map[string]int{
+	"prestore":  2,
+	"poststore": 2,
+}
+
 type EventMap map[string][][]string
 type EventActionMap map[string][]EventActioner
 
+// EventHandler runs the actions of the events, they're replaced
+// as a whole when the config is reloaded
 type EventHandler struct {
+	lock    sync.RWMutex
 	actions EventActionMap
 }
 
+// Parse replaces the actions with the ones of the events,
+// the invalid events are skipped with a warning
 func (this *EventHandler) Parse(events EventMap) {
-	if this.actions == nil {
-		this.actions = make(EventActionMap)
-	}
+	evt_map := make(EventActionMap)
 
 	for raw_type, actions := range events {
 		evt_type := strings.ToLower(raw_type)
@@ -33,11 +43,15 @@ func (this *EventHandler) Parse(events EventMap) {
 			continue
 		}
 
-		this.actions[evt_type] = evt_actions
+		evt_map[evt_type] = evt_actions
 	}
+
+	this.lock.Lock()
+	this.actions = evt_map
+	this.lock.Unlock()
 }
 
-func (this EventHandler) parseActions(evt_type string, actions [][]string) ([]EventActioner, error) {
+func (this *EventHandler) parseActions(evt_type string, actions [][]string) ([]EventActioner, error) {
 	if len(actions) == 0 {
 		return nil, ErrInvalidEventData
 	}
@@ -49,6 +63,10 @@ func (this EventHandler) parseActions(evt_type string, actions [][]string) ([]Ev
 	evt_actions := []EventActioner{}
 
 	for _, data := range actions {
+		if len(data) == 0 {
+			return nil, ErrInvalidEventData
+		}
+
 		action_type := strings.ToLower(data[0])
 
 		evt_action, err := this.parseAction(action_type, data[1:])
@@ -62,7 +80,7 @@ func (this EventHandler) parseActions(evt_type string, actions [][]string) ([]Ev
 	return evt_actions, nil
 }
 
-func (this EventHandler) parseAction(action_type string, data []string) (EventActioner, error) {
+func (this *EventHandler) parseAction(action_type string, data []string) (EventActioner, error) {
 	evt_action := getEventAction(action_type, data)
 
 	if evt_action == nil {
@@ -72,8 +90,10 @@ func (this EventHandler) parseAction(action_type string, data []string) (EventAc
 	return evt_action, nil
 }
 
-func (this EventHandler) Handle(e_type string, args ...string) {
+func (this *EventHandler) Handle(e_type string, args ...string) {
+	this.lock.RLock()
 	actions, ok := this.actions[e_type]
+	this.lock.RUnlock()
 
 	if !ok {
 		return
@@ -91,12 +111,6 @@ func (this EventHandler) Handle(e_type string, args ...string) {
 }
 
 func validateEventType(evt string) bool {
-	evt = strings.ToLower(evt)
-
-	switch evt {
-	case "prestore", "poststore":
-		return true
-	}
-
-	return false
+	_, ok := eventArgs[strings.ToLower(evt)]
+	return ok
 }
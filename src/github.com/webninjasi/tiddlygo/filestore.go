@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+const (
+	c_storageFile     = "file"
+	c_storageTiddlers = "tiddlers"
+)
+
+// FileStore keeps the wikis in a directory, each one either as an html file
+// or as a tiddler directory. Storage decides which one a saved wiki becomes;
+// a wiki which is already a tiddler directory stays one.
+type FileStore struct {
+	Dir     string
+	Storage string
+
+	lock sync.Mutex
+}
+
+func NewFileStore(dir string, storage string) *FileStore {
+	return &FileStore{
+		Dir:     dir,
+		Storage: storage,
+	}
+}
+
+// filePath returns the path of a wiki stored as an html file
+func (this *FileStore) filePath(name string) string {
+	return filepath.Join(this.Dir, name)
+}
+
+// dirPath returns the path of a wiki stored as a tiddler directory
+func (this *FileStore) dirPath(name string) string {
+	return filepath.Join(this.Dir, strings.TrimSuffix(name, ".html"))
+}
+
+// tiddlerDir returns the tiddler directory of a wiki if it is stored as one
+func (this *FileStore) tiddlerDir(name string) (*TiddlerDir, bool) {
+	path := this.dirPath(name)
+	if !isTiddlerDir(path) {
+		return nil, false
+	}
+
+	return getTiddlerDir(path), true
+}
+
+func (this *FileStore) List() ([]WikiInfo, error) {
+	files, err := ioutil.ReadDir(this.Dir)
+	if os.IsNotExist(err) {
+		return []WikiInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wikis := []WikiInfo{}
+
+	for _, f := range files {
+		name := f.Name()
+
+		// Wikis stored as tiddlers are directories
+		if f.IsDir() && !strings.HasPrefix(name, ".") && isTiddlerDir(filepath.Join(this.Dir, name)) {
+			info, err := this.Stat(name + ".html")
+			if err != nil {
+				continue
+			}
+
+			wikis = append(wikis, info)
+			continue
+		}
+
+		if !f.IsDir() && len(name) > 5 && name[len(name)-5:] == ".html" {
+			wikis = append(wikis, WikiInfo{name, f.Size(), f.ModTime()})
+		}
+	}
+
+	sort.Slice(wikis, func(i, j int) bool {
+		return wikis[i].Name < wikis[j].Name
+	})
+
+	return wikis, nil
+}
+
+// Stat returns the total size and the latest change of all files of a wiki
+// stored as tiddlers, which is enough to tell whether it has changed
+func (this *FileStore) Stat(name string) (WikiInfo, error) {
+	path := this.dirPath(name)
+
+	if !isTiddlerDir(path) {
+		info, err := os.Stat(this.filePath(name))
+		if err != nil {
+			return WikiInfo{}, err
+		}
+
+		if info.IsDir() {
+			return WikiInfo{}, os.ErrNotExist
+		}
+
+		return WikiInfo{name, info.Size(), info.ModTime()}, nil
+	}
+
+	wiki := WikiInfo{Name: name}
+
+	for _, dir := range []string{path, filepath.Join(path, c_tiddlersDir)} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return WikiInfo{}, err
+		}
+
+		if info, err := os.Stat(dir); err == nil && info.ModTime().After(wiki.ModTime) {
+			wiki.ModTime = info.ModTime()
+		}
+
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+
+			wiki.Size += f.Size()
+
+			if f.ModTime().After(wiki.ModTime) {
+				wiki.ModTime = f.ModTime()
+			}
+		}
+	}
+
+	return wiki, nil
+}
+
+func (this *FileStore) Open(name string) (io.ReadCloser, error) {
+	dir, ok := this.tiddlerDir(name)
+	if !ok {
+		return os.Open(this.filePath(name))
+	}
+
+	wiki, err := dir.Wiki()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := wiki.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// etag returns the current ETag of a wiki or "" if it doesn't exist
+func (this *FileStore) etag(name string) (string, error) {
+	f, err := this.Open(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hashETag(hash), nil
+}
+
+func (this *FileStore) Save(name string, r io.Reader, ifMatch string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	err := os.MkdirAll(this.Dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	if ifMatch != "" {
+		etag, err := this.etag(name)
+		if err != nil {
+			return "", err
+		}
+
+		if !matchETag(ifMatch, etag) {
+			return "", ErrWikiChanged
+		}
+	}
+
+	if isTiddlerDir(this.dirPath(name)) || this.Storage == c_storageTiddlers {
+		return this.saveTiddlerDir(name, r)
+	}
+
+	path := this.filePath(name)
+
+	// Write into a temp file first, so the old wiki stays intact on any failure
+	out, err := ioutil.TempFile(this.Dir, "."+name+".")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hash := sha1.New()
+
+	_, err = io.Copy(io.MultiWriter(out, hash), r)
+	if err != nil {
+		return "", err
+	}
+
+	err = out.Chmod(fileMode(path, 0644))
+	if err != nil {
+		return "", err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return "", err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(out.Name(), path)
+	if err != nil {
+		return "", err
+	}
+
+	err = syncDir(this.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	return hashETag(hash), nil
+}
+
+// saveTiddlerDir splits a whole wiki into its tiddler directory, which
+// replaces the wiki file if there was one
+func (this *FileStore) saveTiddlerDir(name string, r io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	err = getTiddlerDir(this.dirPath(name)).Store(content)
+	if err != nil {
+		return "", err
+	}
+
+	path := this.filePath(name)
+
+	if isExist(path) {
+		err = os.Remove(path)
+		if err != nil {
+			return "", err
+		}
+
+		err = syncDir(this.Dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return this.etag(name)
+}
+
+// convertToTiddlerDir moves a wiki file into a tiddler directory.
+// The caller must hold the lock.
+func (this *FileStore) convertToTiddlerDir(name string) (*TiddlerDir, error) {
+	if dir, ok := this.tiddlerDir(name); ok {
+		return dir, nil
+	}
+
+	f, err := os.Open(this.filePath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = this.saveTiddlerDir(name, f)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Converted '%v' into the tiddler directory '%v'\n", name, this.dirPath(name))
+
+	return getTiddlerDir(this.dirPath(name)), nil
+}
+
+// withTiddlerDir runs fn on the tiddler directory of a wiki. A wiki file is
+// only moved into one if the storage is "tiddlers", otherwise false is
+// returned and the wiki is left alone.
+func (this *FileStore) withTiddlerDir(name string, fn func(dir *TiddlerDir) error) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	dir, ok := this.tiddlerDir(name)
+	if !ok {
+		if this.Storage != c_storageTiddlers {
+			return false, nil
+		}
+
+		var err error
+
+		dir, err = this.convertToTiddlerDir(name)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, fn(dir)
+}
+
+// PutTiddler only writes the file of the tiddler if the wiki is a tiddler
+// directory, a wiki file is saved as a whole with the change
+func (this *FileStore) PutTiddler(name string, tiddler *tiddlywiki.Tiddler) error {
+	ok, err := this.withTiddlerDir(name, func(dir *TiddlerDir) error {
+		return dir.Put(tiddler)
+	})
+	if !ok {
+		return wholeWikiStore{store: this}.PutTiddler(name, tiddler)
+	}
+
+	return err
+}
+
+func (this *FileStore) DeleteTiddler(name string, title string) (bool, error) {
+	found := false
+
+	ok, err := this.withTiddlerDir(name, func(dir *TiddlerDir) error {
+		var err error
+		found, err = dir.Delete(title)
+		return err
+	})
+	if !ok {
+		return wholeWikiStore{store: this}.DeleteTiddler(name, title)
+	}
+
+	return found, err
+}
+
+func (this *FileStore) Delete(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	path := this.dirPath(name)
+	if isTiddlerDir(path) {
+		forgetTiddlerDir(path)
+		return os.RemoveAll(path)
+	}
+
+	return os.Remove(this.filePath(name))
+}
+
+func (this *FileStore) Rename(oldname string, newname string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if isExist(this.filePath(newname)) || isTiddlerDir(this.dirPath(newname)) {
+		return ErrWikiExists
+	}
+
+	path := this.dirPath(oldname)
+	if isTiddlerDir(path) {
+		forgetTiddlerDir(path)
+		return os.Rename(path, this.dirPath(newname))
+	}
+
+	return os.Rename(this.filePath(oldname), this.filePath(newname))
+}
+
+// Path returns the path of a wiki on the disk, either the html file or the
+// tiddler directory, and whether it's a single file
+func (this *FileStore) Path(name string) (string, bool) {
+	path := this.dirPath(name)
+	if isTiddlerDir(path) {
+		return path, false
+	}
+
+	return this.filePath(name), true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitindex "github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+type GitConfig struct {
+	Message        string `json:"message"`
+	Email          string `json:"email"`
+	Remote         string `json:"remote"`
+	Branch         string `json:"branch"`
+	RemoteUser     string `json:"remoteuser"`
+	RemotePassword string `json:"remotepassword"`
+	Retries        int    `json:"retries"`
+}
+
+type gitCommitInfo struct {
+	Wiki string
+	User string
+	Time time.Time
+}
+
+var gitLock sync.Mutex
+
+func NewGitConfig() GitConfig {
+	return GitConfig{
+		Message: "Update {{.Wiki}} from tiddlygo",
+		Email:   "{{.User}}@tiddlygo",
+		Retries: 5,
+	}
+}
+
+// openGitRepo opens the repository containing the wiki directory
+// and creates one in the wiki directory if there is none
+func openGitRepo() (*git.Repository, error) {
+	err := checkWikiDir()
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpenWithOptions(cfg().WikiDir, &git.PlainOpenOptions{
+		DetectDotGit: true,
+	})
+	if err == git.ErrRepositoryNotExists {
+		return git.PlainInit(cfg().WikiDir, false)
+	}
+
+	return repo, err
+}
+
+// gitPath returns the path of a wiki file relative to the work tree
+func gitPath(worktree *git.Worktree, filename string) (string, error) {
+	root, err := filepath.Abs(worktree.Filesystem.Root())
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Abs(filepath.Join(cfg().WikiDir, filename))
+	if err != nil {
+		return "", err
+	}
+
+	// The wiki directory might be a symlink into the repository
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	path, err = filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(path), nil
+}
+
+func gitAdd(filename string) error {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openGitRepo()
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	path, err := gitPath(worktree, filename)
+	if err != nil {
+		return err
+	}
+
+	if isTiddlerDir(filepath.Join(cfg().WikiDir, strings.TrimSuffix(filename, ".html"))) {
+		// The wiki file is removed once the wiki is moved into a tiddler directory
+		_, err = worktree.Remove(path)
+		if err != nil && err != gitindex.ErrEntryNotFound {
+			return err
+		}
+
+		path = strings.TrimSuffix(path, ".html")
+	}
+
+	_, err = worktree.Add(path)
+
+	return err
+}
+
+func gitCommit(wikiname string, user string) error {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openGitRepo()
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	info := gitCommitInfo{
+		Wiki: wikiname,
+		User: user,
+		Time: time.Now(),
+	}
+
+	if info.User == "" {
+		info.User = "system"
+	}
+
+	msg, err := renderGitTemplate(cfg().Git.Message, info)
+	if err != nil {
+		return err
+	}
+
+	email, err := renderGitTemplate(cfg().Git.Email, info)
+	if err != nil {
+		return err
+	}
+
+	_, err = worktree.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  info.User,
+			Email: email,
+			When:  info.Time,
+		},
+	})
+	if err == git.ErrEmptyCommit {
+		// Nothing has changed since the last commit
+		return nil
+	}
+
+	return err
+}
+
+func renderGitTemplate(text string, info gitCommitInfo) (string, error) {
+	tpl, err := template.New("git").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	err = tpl.Execute(&buf, info)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const c_gitRemoteName = "tiddlygo"
+const c_gitMaxBackoff = 5 * time.Minute
+
+var (
+	ErrNoGitRemote = errors.New("No git remote is configured!")
+	ErrGitConflict = errors.New("The remote branch has diverged, it needs to be merged by hand!")
+)
+
+type GitSyncStatus struct {
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Conflict bool      `json:"conflict"`
+	Pending  bool      `json:"pending"`
+}
+
+type GitSyncer struct {
+	lock    sync.Mutex
+	once    sync.Once
+	queue   chan string
+	pending map[string]bool
+	status  map[string]GitSyncStatus
+}
+
+var gitSyncer = GitSyncer{}
+
+// Enqueue schedules a push or pull in the background. A command
+// which is already waiting to run isn't scheduled twice.
+func (this *GitSyncer) Enqueue(command string) {
+	this.once.Do(func() {
+		this.queue = make(chan string, 2)
+		this.pending = make(map[string]bool)
+		this.status = make(map[string]GitSyncStatus)
+
+		go this.loop()
+	})
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.pending[command] {
+		return
+	}
+
+	this.pending[command] = true
+
+	status := this.status[command]
+	status.Pending = true
+	this.status[command] = status
+
+	this.queue <- command
+}
+
+func (this *GitSyncer) Status() map[string]GitSyncStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	status := map[string]GitSyncStatus{}
+
+	for command, st := range this.status {
+		status[command] = st
+	}
+
+	return status
+}
+
+func (this *GitSyncer) loop() {
+	for command := range this.queue {
+		this.lock.Lock()
+		// Changes made from now on need another run
+		this.pending[command] = false
+		this.lock.Unlock()
+
+		this.run(command)
+	}
+}
+
+func (this *GitSyncer) run(command string) {
+	var err error
+
+	attempt := 0
+	backoff := time.Second
+
+	for {
+		attempt++
+
+		switch command {
+		case "push":
+			err = gitPush()
+		case "pull":
+			err = gitPull()
+		default:
+			err = ErrInvalidGitCommand
+		}
+
+		if err == nil || err == ErrGitConflict || err == ErrNoGitRemote || attempt >= cfg().Git.Retries {
+			break
+		}
+
+		log.Printf("Warning: git %v failed (attempt %v), retrying in %v: %v\n", command, attempt, backoff, err)
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > c_gitMaxBackoff {
+			backoff = c_gitMaxBackoff
+		}
+	}
+
+	if err != nil {
+		log.Printf("Warning: git %v failed: %v\n", command, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	status := GitSyncStatus{
+		Time:     time.Now(),
+		Attempts: attempt,
+		Conflict: err == ErrGitConflict,
+		Pending:  this.pending[command],
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	this.status[command] = status
+}
+
+// gitRemote returns the configured remote without storing it in the repository
+func gitRemote(repo *git.Repository) (*git.Remote, error) {
+	remote := cfg().Git.Remote
+	if remote == "" {
+		return nil, ErrNoGitRemote
+	}
+
+	return git.NewRemote(repo.Storer, &gitconfig.RemoteConfig{
+		Name: c_gitRemoteName,
+		URLs: []string{remote},
+	}), nil
+}
+
+func gitAuth() transport.AuthMethod {
+	conf := cfg().Git
+
+	if conf.RemoteUser == "" && conf.RemotePassword == "" {
+		return nil
+	}
+
+	return &githttp.BasicAuth{
+		Username: conf.RemoteUser,
+		Password: conf.RemotePassword,
+	}
+}
+
+// gitBranch returns the configured branch or the checked out one
+func gitBranch(repo *git.Repository) (plumbing.ReferenceName, error) {
+	if branch := cfg().Git.Branch; branch != "" {
+		return plumbing.NewBranchReferenceName(branch), nil
+	}
+
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "", err
+	}
+
+	return head.Target(), nil
+}
+
+func gitPush() error {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openGitRepo()
+	if err != nil {
+		return err
+	}
+
+	remote, err := gitRemote(repo)
+	if err != nil {
+		return err
+	}
+
+	branch, err := gitBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	err = remote.Push(&git.PushOptions{
+		RemoteName: c_gitRemoteName,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(branch + ":" + branch)},
+		Auth:       gitAuth(),
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	if err != nil && (errors.Is(err, git.ErrNonFastForwardUpdate) || gitDiverged(repo, remote, branch)) {
+		return ErrGitConflict
+	}
+
+	return err
+}
+
+// gitDiverged fetches the remote branch and reports whether the local branch
+// doesn't contain it, so it can't be pushed without a merge
+func gitDiverged(repo *git.Repository, remote *git.Remote, branch plumbing.ReferenceName) bool {
+	tracking := plumbing.NewRemoteReferenceName(c_gitRemoteName, branch.Short())
+
+	err := remote.Fetch(&git.FetchOptions{
+		RemoteName: c_gitRemoteName,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + branch + ":" + tracking)},
+		Auth:       gitAuth(),
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return false
+	}
+
+	remoteRef, err := repo.Reference(tracking, true)
+	if err != nil {
+		return false
+	}
+
+	localRef, err := repo.Reference(branch, true)
+	if err != nil {
+		return false
+	}
+
+	remoteCommit, err := repo.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return false
+	}
+
+	localCommit, err := repo.CommitObject(localRef.Hash())
+	if err != nil {
+		return false
+	}
+
+	contained, err := remoteCommit.IsAncestor(localCommit)
+
+	return err == nil && !contained
+}
+
+// gitPull fetches the remote branch and fast-forwards the local one.
+// It never merges or rebases; diverged branches are reported as a conflict.
+func gitPull() error {
+	fetched, err := gitFetch()
+	if err != nil || !fetched {
+		return err
+	}
+
+	// The wiki files are replaced, so no wiki may be saved meanwhile. The store
+	// is locked first, like when a save runs the git actions.
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openGitRepo()
+	if err != nil {
+		return err
+	}
+
+	branch, err := gitBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	tracking := plumbing.NewRemoteReferenceName(c_gitRemoteName, branch.Short())
+
+	remoteRef, err := repo.Reference(tracking, true)
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	localRef, err := repo.Reference(branch, true)
+	if err == plumbing.ErrReferenceNotFound {
+		// Nothing committed locally yet, just take the remote branch.
+		// Its files are written, the untracked ones are left alone.
+		return worktree.Checkout(&git.CheckoutOptions{
+			Hash:   remoteRef.Hash(),
+			Branch: branch,
+			Create: true,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if localRef.Hash() == remoteRef.Hash() {
+		return nil
+	}
+
+	localCommit, err := repo.CommitObject(localRef.Hash())
+	if err != nil {
+		return err
+	}
+
+	remoteCommit, err := repo.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return err
+	}
+
+	behind, err := localCommit.IsAncestor(remoteCommit)
+	if err != nil {
+		return err
+	}
+
+	if !behind {
+		ahead, err := remoteCommit.IsAncestor(localCommit)
+		if err != nil {
+			return err
+		}
+
+		if ahead {
+			return nil
+		}
+
+		return ErrGitConflict
+	}
+
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return err
+	}
+
+	if head.Target() != branch {
+		// The branch isn't checked out, so only the reference needs to move
+		return repo.Storer.SetReference(plumbing.NewHashReference(branch, remoteRef.Hash()))
+	}
+
+	return worktree.Reset(&git.ResetOptions{
+		Commit: remoteRef.Hash(),
+		Mode:   git.MergeReset,
+	})
+}
+
+// gitFetch fetches the remote branch without touching the local one,
+// it reports false if there is nothing to pull
+func gitFetch() (bool, error) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, err := openGitRepo()
+	if err != nil {
+		return false, err
+	}
+
+	remote, err := gitRemote(repo)
+	if err != nil {
+		return false, err
+	}
+
+	branch, err := gitBranch(repo)
+	if err != nil {
+		return false, err
+	}
+
+	tracking := plumbing.NewRemoteReferenceName(c_gitRemoteName, branch.Short())
+
+	err = remote.Fetch(&git.FetchOptions{
+		RemoteName: c_gitRemoteName,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + branch + ":" + tracking)},
+		Auth:       gitAuth(),
+	})
+	if err == transport.ErrEmptyRemoteRepository || isNoMatchingRefSpec(err) {
+		// There is nothing to pull yet
+		return false, nil
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func isNoMatchingRefSpec(err error) bool {
+	var refErr git.NoMatchingRefSpecError
+
+	return errors.As(err, &refErr)
+}
+
+// gitStatus returns the result of the last push and pull to the admins,
+// the errors of the remote may tell more than the others should know
+func gitStatus(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, c_aclDefault, RoleAdmin); !ok {
+		return
+	}
+
+	data := struct {
+		Remote string                   `json:"remote"`
+		Branch string                   `json:"branch"`
+		Status map[string]GitSyncStatus `json:"status"`
+	}{
+		Remote: redactURL(cfg().Git.Remote),
+		Branch: cfg().Git.Branch,
+		Status: gitSyncer.Status(),
+	}
+
+	byt, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byt)
+}
+
+// redactURL hides the password in a remote url
+func redactURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+
+	return u.String()
+}
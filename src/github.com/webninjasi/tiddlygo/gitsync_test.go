@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// useGitWikiDir points the config at a wiki directory which syncs with remote
+func useGitWikiDir(t *testing.T, dir string, remote string) {
+	old := cfg()
+
+	conf := NewConfig()
+	conf.WikiDir = dir
+	conf.Git.Remote = remote
+	conf.Git.Retries = 1
+	setConfig(conf)
+
+	t.Cleanup(func() {
+		setConfig(old)
+	})
+}
+
+// commitWiki writes a wiki file and commits it like the git actions do
+func commitWiki(t *testing.T, content string) {
+	err := ioutil.WriteFile(filepath.Join(cfg().WikiDir, "notes.html"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gitAdd("notes.html")
+	if err != nil {
+		t.Fatal("git add:", err)
+	}
+
+	err = gitCommit("notes.html", "alice")
+	if err != nil {
+		t.Fatal("git commit:", err)
+	}
+}
+
+func readWikiFile(t *testing.T, dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "notes.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestGitSyncWithBareRemote(t *testing.T) {
+	remote := t.TempDir()
+
+	_, err := git.PlainInit(remote, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := t.TempDir()
+	second := t.TempDir()
+
+	// Push from the first wiki directory into the empty remote
+	useGitWikiDir(t, first, remote)
+	commitWiki(t, "one")
+
+	if err := gitPush(); err != nil {
+		t.Fatal("push:", err)
+	}
+
+	bare, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bare.Reference(plumbing.NewBranchReferenceName("master"), true); err != nil {
+		t.Fatal("the remote has no master branch after the push:", err)
+	}
+
+	// A new wiki directory takes the remote branch
+	useGitWikiDir(t, second, remote)
+
+	err = ioutil.WriteFile(filepath.Join(second, "other.html"), []byte("untracked"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gitPull(); err != nil {
+		t.Fatal("pull into an empty repository:", err)
+	}
+
+	if _, err := ioutil.ReadFile(filepath.Join(second, "other.html")); err != nil {
+		t.Fatal("the pull removed an untracked wiki:", err)
+	}
+
+	if content := readWikiFile(t, second); content != "one" {
+		t.Fatalf("pulled %q, want %q", content, "one")
+	}
+
+	commitWiki(t, "two")
+
+	if err := gitPush(); err != nil {
+		t.Fatal("push of the second commit:", err)
+	}
+
+	// The first one fast-forwards
+	useGitWikiDir(t, first, remote)
+
+	if err := gitPull(); err != nil {
+		t.Fatal("fast-forward pull:", err)
+	}
+
+	if content := readWikiFile(t, first); content != "two" {
+		t.Fatalf("pulled %q, want %q", content, "two")
+	}
+
+	// Both change the wiki, so the branches diverge
+	commitWiki(t, "three from the first")
+
+	if err := gitPush(); err != nil {
+		t.Fatal("push of the third commit:", err)
+	}
+
+	useGitWikiDir(t, second, remote)
+	commitWiki(t, "three from the second")
+
+	if err := gitPush(); err != ErrGitConflict {
+		t.Fatalf("push of a diverged branch: got %v, want %v", err, ErrGitConflict)
+	}
+
+	if err := gitPull(); err != ErrGitConflict {
+		t.Fatalf("pull of a diverged branch: got %v, want %v", err, ErrGitConflict)
+	}
+
+	if content := readWikiFile(t, second); content != "three from the second" {
+		t.Fatalf("a conflicting pull changed the wiki to %q", content)
+	}
+}
+
+func TestGitPushWithoutRemote(t *testing.T) {
+	useGitWikiDir(t, t.TempDir(), "")
+	commitWiki(t, "one")
+
+	if err := gitPush(); err != ErrNoGitRemote {
+		t.Fatalf("got %v, want %v", err, ErrNoGitRemote)
+	}
+}
+
+// A pull replaces the wiki files, so it waits for the saves
+func TestGitPullWaitsForSave(t *testing.T) {
+	remote := t.TempDir()
+
+	_, err := git.PlainInit(remote, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := t.TempDir()
+	second := t.TempDir()
+
+	useGitWikiDir(t, first, remote)
+	commitWiki(t, "one")
+
+	if err := gitPush(); err != nil {
+		t.Fatal("push:", err)
+	}
+
+	useGitWikiDir(t, second, remote)
+
+	if err := gitPull(); err != nil {
+		t.Fatal("pull:", err)
+	}
+
+	useGitWikiDir(t, first, remote)
+	commitWiki(t, "two")
+
+	if err := gitPush(); err != nil {
+		t.Fatal("push:", err)
+	}
+
+	useGitWikiDir(t, second, remote)
+
+	// A save is running
+	storeLock.Lock()
+
+	done := make(chan error)
+	go func() {
+		done <- gitPull()
+	}()
+
+	select {
+	case err := <-done:
+		storeLock.Unlock()
+		t.Fatalf("the pull finished during a save: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if content := readWikiFile(t, second); content != "one" {
+		storeLock.Unlock()
+		t.Fatalf("the pull changed the wiki to %q during a save", content)
+	}
+
+	storeLock.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal("pull:", err)
+	}
+
+	if content := readWikiFile(t, second); content != "two" {
+		t.Fatalf("pulled %q, want %q", content, "two")
+	}
+}
+
+// The errors of the remote are only shown to the admins
+func TestGitStatusNeedsAdmin(t *testing.T) {
+	useTestServer(t)
+	router := getRouter()
+
+	tests := []struct {
+		name   string
+		user   string
+		status int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"admin", "tiddlygo", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/git/status", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, "tiddlygo")
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%v: status = %v, want %v", test.name, rec.Code, test.status)
+		}
+	}
+}
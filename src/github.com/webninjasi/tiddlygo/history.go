@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gorilla/mux"
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+const c_maxDiffCells = 4 << 20
+const c_diffContext = 3
+
+var (
+	ErrNoHistory = errors.New("The wiki has no history!")
+)
+
+type WikiCommit struct {
+	Hash    string    `json:"hash"`
+	Url     string    `json:"url"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type TiddlerDiff struct {
+	Title  string        `json:"title"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	Text   []DiffLine    `json:"text,omitempty"`
+}
+
+type FieldChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+type DiffLine struct {
+	Op   string `json:"op"`
+	Line string `json:"line"`
+}
+
+type WikiDiff struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Added    []string      `json:"added"`
+	Removed  []string      `json:"removed"`
+	Modified []TiddlerDiff `json:"modified"`
+}
+
+func listCommits(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	commits, err := wikiCommits(wikiname)
+	if err != nil {
+		historyError(w, wikiname, err)
+		return
+	}
+
+	byt, err := json.Marshal(commits)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byt)
+}
+
+// viewCommit serves a wiki as of a commit, read-only like an old version
+func viewCommit(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	content, err := wikiAtCommit(wikiname, params["rev"])
+	if err != nil {
+		historyError(w, wikiname, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	w.Write(content)
+}
+
+// diffCommits compares two commits of a wiki tiddler by tiddler
+func diffCommits(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	oldContent, err := wikiAtCommit(wikiname, params["from"])
+	if err != nil {
+		historyError(w, wikiname, err)
+		return
+	}
+
+	newContent, err := wikiAtCommit(wikiname, params["to"])
+	if err != nil {
+		historyError(w, wikiname, err)
+		return
+	}
+
+	oldTiddlers, err := wikiTiddlers(oldContent)
+	if err != nil {
+		http.Error(w, "Couldn't read the tiddlers of the wiki!", http.StatusUnprocessableEntity)
+		return
+	}
+
+	newTiddlers, err := wikiTiddlers(newContent)
+	if err != nil {
+		http.Error(w, "Couldn't read the tiddlers of the wiki!", http.StatusUnprocessableEntity)
+		return
+	}
+
+	diff := diffTiddlers(oldTiddlers, newTiddlers)
+	diff.From = params["from"]
+	diff.To = params["to"]
+
+	byt, err := json.Marshal(diff)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byt)
+}
+
+func historyError(w http.ResponseWriter, wikiname string, err error) {
+	switch err {
+	case ErrNoHistory, object.ErrFileNotFound, plumbing.ErrReferenceNotFound, plumbing.ErrObjectNotFound:
+		http.Error(w, "Couldn't find it in the history!", http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, "Couldn't read the history!", http.StatusInternalServerError)
+	log.Printf("Error while reading the history of '%v': %v\n", wikiname, err)
+}
+
+// openWikiHistory opens the repository containing the wiki without creating one
+func openWikiHistory(wikiname string) (*git.Repository, string, error) {
+	repo, err := git.PlainOpenWithOptions(cfg().WikiDir, &git.PlainOpenOptions{
+		DetectDotGit: true,
+	})
+	if err == git.ErrRepositoryNotExists {
+		return nil, "", ErrNoHistory
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, err := gitPath(worktree, wikiname)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return repo, path, nil
+}
+
+func wikiCommits(wikiname string) ([]WikiCommit, error) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, path, err := openWikiHistory(wikiname)
+	if err != nil {
+		return nil, err
+	}
+
+	// A wiki moved into a tiddler directory keeps the history of its file
+	dirpath := strings.TrimSuffix(path, ".html") + "/"
+
+	iter, err := repo.Log(&git.LogOptions{
+		PathFilter: func(p string) bool {
+			return p == path || strings.HasPrefix(p, dirpath)
+		},
+	})
+	if err == plumbing.ErrReferenceNotFound {
+		// Nothing has been committed yet
+		return []WikiCommit{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	commits := []WikiCommit{}
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		commits = append(commits, WikiCommit{
+			Hash:    c.Hash.String(),
+			Url:     "/wikis/" + wikiname + "/commits/" + c.Hash.String(),
+			Author:  c.Author.Name,
+			Email:   c.Author.Email,
+			Time:    c.Author.When,
+			Message: strings.TrimSpace(c.Message),
+		})
+
+		return nil
+	})
+
+	return commits, err
+}
+
+func wikiAtCommit(wikiname string, rev string) ([]byte, error) {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+
+	repo, path, err := openWikiHistory(wikiname)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := commit.File(path)
+	if err == object.ErrFileNotFound {
+		return tiddlerDirAtCommit(commit, strings.TrimSuffix(path, ".html"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// tiddlerDirAtCommit assembles a wiki stored as tiddlers from a commit
+func tiddlerDirAtCommit(commit *object.Commit, path string) ([]byte, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := tree.Tree(path)
+	if err == object.ErrDirectoryNotFound {
+		return nil, object.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	shell, err := dir.File(c_shellFile)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := shell.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := []*tiddlywiki.Tiddler{}
+
+	files, err := dir.Tree(c_tiddlersDir)
+	if err != nil && err != object.ErrDirectoryNotFound {
+		return nil, err
+	}
+
+	if files != nil {
+		entries := map[string]object.TreeEntry{}
+		for _, entry := range files.Entries {
+			entries[entry.Name] = entry
+		}
+
+		for _, entry := range files.Entries {
+			ext := filepath.Ext(entry.Name)
+			metaEntry, hasMeta := entries[entry.Name+".meta"]
+
+			if !entry.Mode.IsFile() || ext == ".meta" || (!hasMeta && ext != ".tid" && ext != ".json") {
+				continue
+			}
+
+			data, err := treeEntryContents(files, entry)
+			if err != nil {
+				return nil, err
+			}
+
+			var meta []byte
+
+			if hasMeta {
+				meta, err = treeEntryContents(files, metaEntry)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			tiddler, err := parseTiddlerFile(entry.Name, data, meta)
+			if err != nil {
+				continue
+			}
+
+			tiddlers = append(tiddlers, tiddler)
+		}
+	}
+
+	wiki, err := assembleWiki([]byte(content), tiddlers)
+	if err != nil {
+		return nil, err
+	}
+
+	return wiki.Bytes()
+}
+
+func treeEntryContents(tree *object.Tree, entry object.TreeEntry) ([]byte, error) {
+	file, err := tree.TreeEntryFile(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// wikiTiddlers returns the fields of each tiddler in a wiki by title
+func wikiTiddlers(content []byte) (map[string]map[string]string, error) {
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := map[string]map[string]string{}
+
+	for _, tiddler := range wiki.Tiddlers() {
+		tiddlers[tiddler.Title] = tiddler.Map()
+	}
+
+	return tiddlers, nil
+}
+
+func diffTiddlers(oldTiddlers, newTiddlers map[string]map[string]string) WikiDiff {
+	diff := WikiDiff{
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []TiddlerDiff{},
+	}
+
+	for title, newFields := range newTiddlers {
+		oldFields, ok := oldTiddlers[title]
+		if !ok {
+			diff.Added = append(diff.Added, title)
+			continue
+		}
+
+		tdiff := TiddlerDiff{
+			Title: title,
+		}
+
+		for _, name := range fieldNames(oldFields, newFields) {
+			if name == "text" || oldFields[name] == newFields[name] {
+				continue
+			}
+
+			tdiff.Fields = append(tdiff.Fields, FieldChange{
+				Name: name,
+				Old:  oldFields[name],
+				New:  newFields[name],
+			})
+		}
+
+		if oldFields["text"] != newFields["text"] {
+			tdiff.Text = diffLines(oldFields["text"], newFields["text"])
+		}
+
+		if len(tdiff.Fields) > 0 || len(tdiff.Text) > 0 {
+			diff.Modified = append(diff.Modified, tdiff)
+		}
+	}
+
+	for title := range oldTiddlers {
+		if _, ok := newTiddlers[title]; !ok {
+			diff.Removed = append(diff.Removed, title)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].Title < diff.Modified[j].Title
+	})
+
+	return diff
+}
+
+func fieldNames(a, b map[string]string) []string {
+	names := []string{}
+
+	for name := range a {
+		names = append(names, name)
+	}
+
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// diffLines makes a line diff of two texts using their longest common subsequence.
+// Texts too long to compare line by line are shown as replaced.
+func diffLines(oldText, newText string) []DiffLine {
+	a := strings.Split(oldText, "\n")
+	b := strings.Split(newText, "\n")
+
+	lines := []DiffLine{}
+
+	// Common lines at both ends don't need to be compared
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, DiffLine{" ", a[prefix]})
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, DiffLine{" ", line})
+	}
+
+	return trimContext(lines, c_diffContext)
+}
+
+func diffMiddle(a, b []string) []DiffLine {
+	lines := []DiffLine{}
+
+	if len(a)*len(b) > c_maxDiffCells {
+		for _, line := range a {
+			lines = append(lines, DiffLine{"-", line})
+		}
+		for _, line := range b {
+			lines = append(lines, DiffLine{"+", line})
+		}
+
+		return lines
+	}
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{" ", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{"-", a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{"-", a[i]})
+	}
+
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{"+", b[j]})
+	}
+
+	return lines
+}
+
+// trimContext drops unchanged lines which are far from any change
+func trimContext(lines []DiffLine, context int) []DiffLine {
+	near := make([]bool, len(lines))
+
+	for idx, line := range lines {
+		if line.Op == " " {
+			continue
+		}
+
+		for k := idx - context; k <= idx+context; k++ {
+			if k >= 0 && k < len(lines) {
+				near[k] = true
+			}
+		}
+	}
+
+	trimmed := []DiffLine{}
+
+	for idx, line := range lines {
+		if near[idx] {
+			trimmed = append(trimmed, line)
+		} else if idx == 0 || near[idx-1] {
+			trimmed = append(trimmed, DiffLine{"@", "..."})
+		}
+	}
+
+	return trimmed
+}
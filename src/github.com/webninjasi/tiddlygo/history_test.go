@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+// diffText writes the lines of a diff like a unified diff does
+func diffText(lines []DiffLine) string {
+	text := []string{}
+
+	for _, line := range lines {
+		text = append(text, line.Op+line.Line)
+	}
+
+	return strings.Join(text, "\n")
+}
+
+func numberedLines(prefix string, from int, to int) []string {
+	lines := []string{}
+
+	for i := from; i <= to; i++ {
+		lines = append(lines, fmt.Sprintf("%v%d", prefix, i))
+	}
+
+	return lines
+}
+
+func TestDiffLines(t *testing.T) {
+	ten := strings.Join(numberedLines("line ", 1, 10), "\n")
+
+	tests := []struct {
+		name    string
+		oldText string
+		newText string
+		diff    string
+	}{
+		{
+			name:    "changed line with context",
+			oldText: ten,
+			newText: strings.Replace(ten, "line 5\n", "line five\n", 1),
+			diff:    "@...\n line 2\n line 3\n line 4\n-line 5\n+line five\n line 6\n line 7\n line 8\n@...",
+		},
+		{
+			name:    "added at the end",
+			oldText: "one\ntwo",
+			newText: "one\ntwo\nthree",
+			diff:    " one\n two\n+three",
+		},
+		{
+			name:    "removed at the start",
+			oldText: "zero\none\ntwo",
+			newText: "one\ntwo",
+			diff:    "-zero\n one\n two",
+		},
+		{
+			name:    "moved line",
+			oldText: "a\nb\nc",
+			newText: "b\nc\na",
+			diff:    "-a\n b\n c\n+a",
+		},
+		{
+			name:    "from nothing",
+			oldText: "",
+			newText: "one",
+			diff:    "-\n+one",
+		},
+		{
+			name:    "two changes far apart",
+			oldText: strings.Join(numberedLines("", 1, 20), "\n"),
+			newText: strings.Replace(strings.Replace(strings.Join(numberedLines("", 1, 20), "\n"), "\n2\n", "\ntwo\n", 1), "\n19\n", "\nnineteen\n", 1),
+			diff:    " 1\n-2\n+two\n 3\n 4\n 5\n@...\n 16\n 17\n 18\n-19\n+nineteen\n 20",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := diffText(diffLines(test.oldText, test.newText)); diff != test.diff {
+				t.Fatalf("diff:\n%v\nwant:\n%v", diff, test.diff)
+			}
+		})
+	}
+}
+
+// Texts with too many lines to compare are shown as replaced, only the
+// common lines at both ends are kept
+func TestDiffLinesTooLong(t *testing.T) {
+	oldLines := append(append([]string{"first"}, numberedLines("old ", 1, 2100)...), "last")
+	newLines := append(append([]string{"first"}, numberedLines("new ", 1, 2100)...), "last")
+
+	if 2100*2100 <= c_maxDiffCells {
+		t.Fatal("the texts aren't too long to compare")
+	}
+
+	lines := diffLines(strings.Join(oldLines, "\n"), strings.Join(newLines, "\n"))
+
+	if len(lines) != 2+2*2100 {
+		t.Fatalf("%v lines, want %v", len(lines), 2+2*2100)
+	}
+
+	if lines[0] != (DiffLine{" ", "first"}) || lines[len(lines)-1] != (DiffLine{" ", "last"}) {
+		t.Fatalf("the common lines are lost: %v ... %v", lines[0], lines[len(lines)-1])
+	}
+
+	for i, line := range lines[1 : len(lines)-1] {
+		var want DiffLine
+		if i < 2100 {
+			want = DiffLine{"-", oldLines[i+1]}
+		} else {
+			want = DiffLine{"+", newLines[i-2100+1]}
+		}
+
+		if line != want {
+			t.Fatalf("line %v = %v, want %v", i+1, line, want)
+		}
+	}
+}
+
+func TestDiffTiddlers(t *testing.T) {
+	oldTiddlers := map[string]map[string]string{
+		"Same":    {"title": "Same", "text": "same"},
+		"Removed": {"title": "Removed", "text": "gone"},
+		"Tagged":  {"title": "Tagged", "text": "text", "tags": "one"},
+		"Edited":  {"title": "Edited", "text": "one\ntwo"},
+	}
+
+	newTiddlers := map[string]map[string]string{
+		"Same":   {"title": "Same", "text": "same"},
+		"Added":  {"title": "Added", "text": "new"},
+		"Tagged": {"title": "Tagged", "text": "text", "tags": "two", "color": "red"},
+		"Edited": {"title": "Edited", "text": "one\n2"},
+	}
+
+	diff := diffTiddlers(oldTiddlers, newTiddlers)
+
+	if strings.Join(diff.Added, ",") != "Added" || strings.Join(diff.Removed, ",") != "Removed" {
+		t.Fatalf("added %v, removed %v", diff.Added, diff.Removed)
+	}
+
+	if len(diff.Modified) != 2 || diff.Modified[0].Title != "Edited" || diff.Modified[1].Title != "Tagged" {
+		t.Fatalf("modified %+v", diff.Modified)
+	}
+
+	if diff.Modified[0].Fields != nil || diffText(diff.Modified[0].Text) != " one\n-two\n+2" {
+		t.Fatalf("change of Edited: %+v", diff.Modified[0])
+	}
+
+	fields := []FieldChange{{"color", "", "red"}, {"tags", "one", "two"}}
+
+	if !reflect.DeepEqual(diff.Modified[1].Fields, fields) || diff.Modified[1].Text != nil {
+		t.Fatalf("change of Tagged: %+v", diff.Modified[1])
+	}
+}
+
+// commitTiddlers commits the test wiki with the tiddlers
+func commitTiddlers(t *testing.T, tiddlers map[string]string) string {
+	wiki, err := tiddlywiki.Parse(readTestTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for title, text := range tiddlers {
+		tiddler := tiddlywiki.NewTiddler(title)
+		tiddler.SetField("text", text)
+		wiki.Put(tiddler)
+	}
+
+	content, err := wiki.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitWiki(t, string(content))
+
+	return string(content)
+}
+
+func TestWikiHistory(t *testing.T) {
+	useGitWikiDir(t, t.TempDir(), "")
+
+	if commits, err := wikiCommits("notes.html"); err != ErrNoHistory || commits != nil {
+		t.Fatalf("history without a repository: %v, %v", commits, err)
+	}
+
+	first := commitTiddlers(t, map[string]string{
+		"Kept":    "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine",
+		"Removed": "gone",
+	})
+
+	second := commitTiddlers(t, map[string]string{
+		"Kept":  "one\ntwo\nthree\nfour\nFIVE\nsix\nseven\neight\nnine",
+		"Added": "new",
+	})
+
+	commits, err := wikiCommits("notes.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commits) != 2 || commits[0].Author != "alice" {
+		t.Fatalf("commits = %+v", commits)
+	}
+
+	for rev, want := range map[string]string{
+		commits[1].Hash:     first,
+		commits[0].Hash[:7]: second,
+		"HEAD~1":            first,
+		"master":            second,
+	} {
+		content, err := wikiAtCommit("notes.html", rev)
+		if err != nil {
+			t.Fatalf("wiki at %v: %v", rev, err)
+		}
+
+		if string(content) != want {
+			t.Fatalf("the wiki at %v isn't the committed one", rev)
+		}
+	}
+
+	if _, err := wikiAtCommit("notes.html", "0123456789abcdef"); err != plumbing.ErrReferenceNotFound {
+		t.Fatalf("wiki at an unknown commit: got %v, want %v", err, plumbing.ErrReferenceNotFound)
+	}
+
+	if _, err := wikiAtCommit("other.html", commits[0].Hash); err == nil {
+		t.Fatal("a wiki which was never committed was found")
+	}
+
+	// The diff of the commits over HTTP
+	rec := httptest.NewRecorder()
+	getRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/wikis/notes.html/diff/"+commits[1].Hash+"/"+commits[0].Hash, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("diff: status = %v: %v", rec.Code, rec.Body.String())
+	}
+
+	var diff WikiDiff
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(diff.Added, ",") != "Added" || strings.Join(diff.Removed, ",") != "Removed" {
+		t.Fatalf("added %v, removed %v", diff.Added, diff.Removed)
+	}
+
+	if len(diff.Modified) != 1 || diff.Modified[0].Title != "Kept" {
+		t.Fatalf("modified %+v", diff.Modified)
+	}
+
+	want := "@...\n two\n three\n four\n-five\n+FIVE\n six\n seven\n eight\n@..."
+
+	if text := diffText(diff.Modified[0].Text); text != want {
+		t.Fatalf("diff of Kept:\n%v\nwant:\n%v", text, want)
+	}
+
+	// An unknown commit isn't found
+	rec = httptest.NewRecorder()
+	getRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/wikis/notes.html/diff/"+commits[1].Hash+"/abcdef0", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("diff with an unknown commit: status = %v", rec.Code)
+	}
+}
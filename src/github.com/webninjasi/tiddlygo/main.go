@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,16 +14,20 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
+	"sync"
 
-	"github.com/cratonica/trayhost"
 	"github.com/gorilla/mux"
 )
 
 const c_configFile = "tiddlygo.json"
 const c_maxFileSize = 32 << 20
 
+var (
+	ErrWikiChanged = errors.New("The wiki has been changed by someone else since you opened it!")
+	ErrInvalidWiki = errors.New("The file doesn't look like a TiddlyWiki!")
+)
+
 type WikiList struct {
 	Pages []Page `json:"pages"`
 }
@@ -36,58 +43,118 @@ type WikiTemplate struct {
 	Selected bool   `json:"selected"`
 }
 
-var cfg = NewConfig()
 var evtHandler = EventHandler{}
 var serverURL string
+var storeLock sync.Mutex
 
 func main() {
-	// EnterLoop must be called on the OS's main thread
-	runtime.LockOSThread()
+	args, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
 
-	err := cfg.ReadFile(c_configFile)
-	if err != nil && !os.IsNotExist(err) {
-		log.Fatalln("Error while reading config file:", err)
+	// The server is started by default, e.g. when the app is opened from a desktop
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
 
-	evtHandler.Parse(cfg.Events)
+	if command == "check-config" {
+		exitOnError(checkConfigCommand(args))
+		return
+	}
 
-	router := getRouter()
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command:", command)
+		fmt.Fprintln(os.Stderr, c_usage)
+		os.Exit(2)
+	}
 
-	go func() {
-		log.Println("Listening the server on", cfg.Address)
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatalln("Error while reading config file:", err)
+	}
 
-		err := http.ListenAndServe(cfg.Address, router)
-		if err != nil {
-			log.Fatalln("Error while listening server:", err)
-		}
-	}()
+	setConfig(conf)
 
-	serverURL = toHttpAddr(cfg.Address)
+	exitOnError(run(args))
+}
 
-	trayhost.SetUrl(serverURL)
-	trayhost.EnterLoop("TiddlyGo", iconData)
+// exitOnError ends a command with its error
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func getRouter() *mux.Router {
 	router := mux.NewRouter()
+	// Keep titles with slashes in a single path segment, e.g. "$:/StoryList"
+	router.UseEncodedPath()
 	router.HandleFunc("/", index).Methods("GET")
+	router.HandleFunc("/login", loginPage).Methods("GET")
+	router.HandleFunc("/login", login).Methods("POST")
+	router.HandleFunc("/login/oidc", loginOIDC).Methods("GET")
+	router.HandleFunc(c_oidcCallback, oidcCallback).Methods("GET")
+	router.HandleFunc("/logout", logout).Methods("POST")
+	router.HandleFunc("/session", sessionStatus).Methods("GET")
 	router.HandleFunc("/wikilist", listWiki).Methods("GET")
 	router.HandleFunc("/wikitemplates", listWikiTemplates).Methods("GET")
 	router.HandleFunc("/store", storeWiki).Methods("POST")
 	router.HandleFunc("/new", newWiki).Methods("POST")
-	router.HandleFunc("/{wikiname:\\w+\\.html}", viewWiki).Methods("GET")
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir(cfg.PublicDir)))
+	router.HandleFunc("/{wikiname:\\w+\\.html}", viewWiki).Methods("GET", "HEAD")
+	router.HandleFunc("/{wikiname:\\w+\\.html}", optionsWiki).Methods("OPTIONS")
+	router.HandleFunc("/{wikiname:\\w+\\.html}", putWiki).Methods("PUT")
+	// The versions are at /wikis/{name}/versions, the name with .html is kept as an alias
+	router.HandleFunc("/wikis/{wikiname:\\w+(?:\\.html)?}/versions", listVersions).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+(?:\\.html)?}/versions/{id:[0-9T.Z]+}", viewVersion).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+(?:\\.html)?}/versions/{id:[0-9T.Z]+}/restore", restoreVersion).Methods("POST")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/commits", listCommits).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/commits/{rev:[0-9a-f]{4,40}}", viewCommit).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/diff/{from:[0-9a-f]{4,40}}/{to:[0-9a-f]{4,40}}", diffCommits).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/status", tiddlyWebStatus).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/recipes/default/tiddlers.json", listTiddlyWebTiddlers).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/recipes/default/tiddlers/{title}", getTiddlyWebTiddler).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/recipes/default/tiddlers/{title}", putTiddlyWebTiddler).Methods("PUT")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/bags/default/tiddlers/{title}", getTiddlyWebTiddler).Methods("GET")
+	router.HandleFunc("/wikis/{wikiname:\\w+\\.html}/bags/default/tiddlers/{title}", deleteTiddlyWebTiddler).Methods("DELETE")
+	router.HandleFunc("/git/status", gitStatus).Methods("GET")
+	router.HandleFunc("/api/tokens", listTokens).Methods("GET")
+	router.HandleFunc("/api/tokens", createToken).Methods("POST")
+	router.HandleFunc("/api/tokens/{id:[0-9a-f]+}", revokeToken).Methods("DELETE")
+	router.HandleFunc("/api/acl", getACL).Methods("GET")
+	router.HandleFunc("/api/acl", putACL).Methods("PUT")
+	router.HandleFunc("/api/wikis/{wikiname:\\w+\\.html}/acl", getWikiACL).Methods("GET")
+	router.HandleFunc("/api/wikis/{wikiname:\\w+\\.html}/acl", putWikiACL).Methods("PUT")
+	router.HandleFunc("/api/wikis/{wikiname:\\w+\\.html}/acl", deleteWikiACL).Methods("DELETE")
+	router.HandleFunc("/api/wikis/{wikiname:\\w+\\.html}/tiddlers", listTiddlers).Methods("GET")
+	router.HandleFunc("/api/wikis/{wikiname:\\w+\\.html}/tiddlers/{title}", getTiddler).Methods("GET")
+	router.PathPrefix("/").HandlerFunc(servePublic)
 
 	return router
 }
 
 func index(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, cfg.PublicDir+"/index.html")
+	http.ServeFile(w, r, cfg().PublicDir+"/index.html")
+}
+
+// servePublic serves the files of publicdir, which is looked up for every
+// request so it can be changed in the config file
+func servePublic(w http.ResponseWriter, r *http.Request) {
+	http.FileServer(http.Dir(cfg().PublicDir)).ServeHTTP(w, r)
 }
 
 func listWiki(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir(cfg.WikiDir + "/")
+	login, _ := requestUser(r)
+
+	wikis, err := wikiStore().List()
 	if err != nil {
+		log.Println("Error while listing wikis:", err)
 		return
 	}
 
@@ -95,14 +162,16 @@ func listWiki(w http.ResponseWriter, r *http.Request) {
 		Pages: []Page{},
 	}
 
-	for _, f := range files {
-		name := f.Name()
-		if len(name) > 5 && name[len(name)-5:] == ".html" {
-			data.Pages = append(data.Pages, Page{
-				Url:  "/" + name,
-				Name: name,
-			})
+	for _, wiki := range wikis {
+		// Only the wikis the user may read are listed
+		if login.Role(wiki.Name) < RoleRead {
+			continue
 		}
+
+		data.Pages = append(data.Pages, Page{
+			Url:  "/" + wiki.Name,
+			Name: wiki.Name,
+		})
 	}
 
 	byt, err := json.Marshal(data)
@@ -114,7 +183,7 @@ func listWiki(w http.ResponseWriter, r *http.Request) {
 }
 
 func listWikiTemplates(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir(cfg.TemplateDir)
+	files, err := ioutil.ReadDir(cfg().TemplateDir)
 	if err != nil {
 		return
 	}
@@ -149,12 +218,42 @@ func viewWiki(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	wikiname := params["wikiname"]
 
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
 	// Disable Caching
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
 
-	http.ServeFile(w, r, filepath.Join(cfg.WikiDir, wikiname))
+	info, err := wikiStore().Stat(wikiname)
+	if err == nil {
+		var content []byte
+
+		content, err = readWiki(wikiname)
+		if err == nil {
+			w.Header().Set("ETag", contentETag(content))
+
+			// Point the tiddlyweb plugin at the endpoints of the wiki
+			if hasTiddlyWeb(wikiname) {
+				content, err = injectTiddlyWebHost(wikiname, content)
+			}
+		}
+
+		if err == nil {
+			http.ServeContent(w, r, wikiname, info.ModTime, bytes.NewReader(content))
+			return
+		}
+	}
+
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Error(w, "Couldn't read the wiki!", http.StatusInternalServerError)
+	log.Printf("Error while reading '%v': %v\n", wikiname, err)
 }
 
 func storeWiki(w http.ResponseWriter, r *http.Request) {
@@ -174,27 +273,33 @@ func storeWiki(w http.ResponseWriter, r *http.Request) {
 
 	options := parseOptions(optionsStr[0])
 
-	user, ok := options["user"]
-	if !ok {
-		fmt.Fprintf(w, "Couldn't find 'user' in the form data!")
+	// Scripts can send an API token instead of the user and password
+	login, ok := tokenLogin(r)
+	if _, hasToken := bearerToken(r); hasToken && !ok {
+		fmt.Fprintln(w, "Error: Invalid API token!")
 		return
 	}
 
-	pass, ok := options["password"]
 	if !ok {
-		fmt.Fprintf(w, "Couldn't find 'password' in the form data!")
-		return
-	}
+		user, ok := options["user"]
+		if !ok {
+			fmt.Fprintf(w, "Couldn't find 'user' in the form data!")
+			return
+		}
 
-	if user != cfg.Username {
-		fmt.Fprintln(w, "Error: Username do not match!")
-		fmt.Fprintf(w, "Username: [%v]\n", user)
-		return
-	}
+		pass, ok := options["password"]
+		if !ok {
+			fmt.Fprintf(w, "Couldn't find 'password' in the form data!")
+			return
+		}
 
-	if pass != cfg.Password {
-		fmt.Fprintln(w, "Error: Password do not match!")
-		return
+		if !checkCredentials(user, pass) {
+			fmt.Fprintln(w, "Error: Username or password do not match!")
+			fmt.Fprintf(w, "Username: [%v]\n", user)
+			return
+		}
+
+		login = Login{User: user}
 	}
 
 	inp, handler, err := r.FormFile("userfile")
@@ -213,43 +318,145 @@ func storeWiki(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wikipath := filepath.Join(cfg.WikiDir, wikiname)
+	if login.Role(wikiname) < RoleWrite {
+		fmt.Fprintln(w, "Error: You aren't allowed to store this wiki!")
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if etag, ok := options["etag"]; ok {
+		ifMatch = etag
+	}
 
-	err = checkWikiDir()
+	etag, err := saveWiki(wikiname, inp, ifMatch, login.User)
+	if err == ErrWikiChanged {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintln(w, "Error:", err)
+		fmt.Fprintln(w, "Reload the wiki and make your changes again.")
+		return
+	}
+	if err == ErrInvalidWiki {
+		fmt.Fprintln(w, "Error:", err)
+		return
+	}
 	if err != nil {
 		fmt.Fprintln(w, "Couldn't upload the file!")
-		log.Printf("Error while creating '%v': %v\n", cfg.WikiDir, err)
+		log.Printf("Error while storing '%v': %v\n", wikiname, err)
 		return
 	}
 
-	out, err := os.Create(wikipath)
-	if err != nil {
-		fmt.Fprintln(w, "Couldn't upload the file!")
-		log.Printf("Error while creating '%v': %v\n", wikipath, err)
+	w.Header().Set("ETag", etag)
+	fmt.Fprintf(w, "0 - File successfully loaded in '%v'\n", wikiname)
+	log.Printf("Successfully uploaded: '%v'\n", wikiname)
+}
+
+// optionsWiki tells TiddlyWiki5's PUT saver that the wiki can be saved in place
+func optionsWiki(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT")
+	w.Header().Set("DAV", "1")
+	w.WriteHeader(http.StatusOK)
+}
+
+// putWiki stores a wiki sent by TiddlyWiki5's PUT saver
+func putWiki(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	user, ok := authorize(w, r, wikiname, RoleWrite)
+	if !ok {
 		return
 	}
-	defer out.Close()
 
-	evtHandler.Handle("prestore", wikiname)
+	inp := http.MaxBytesReader(w, r.Body, c_maxFileSize)
+	defer inp.Close()
 
-	_, err = io.Copy(out, inp)
+	etag, err := saveWiki(wikiname, inp, r.Header.Get("If-Match"), user)
+	if err == ErrWikiChanged {
+		http.Error(w, err.Error()+" Reload the wiki and make your changes again.", http.StatusPreconditionFailed)
+		return
+	}
+	if err == ErrInvalidWiki {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		fmt.Fprintln(w, "Couldn't upload the file!")
-		log.Printf("Error while copying to '%v': %v\n", wikipath, err)
+		http.Error(w, "Couldn't store the file!", http.StatusInternalServerError)
+		log.Printf("Error while storing '%v': %v\n", wikiname, err)
 		return
 	}
 
-	err = out.Sync()
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("Successfully stored: '%v'\n", wikiname)
+}
+
+// saveWiki stores the wiki and fires the store events around it.
+// If ifMatch is given, the wiki isn't overwritten unless its current ETag matches.
+func saveWiki(wikiname string, inp io.Reader, ifMatch string, user string) (string, error) {
+	// Read it all first, so nothing is written unless it's a valid wiki
+	content, err := ioutil.ReadAll(inp)
+	if err != nil {
+		return "", err
+	}
+
+	if len(content) == 0 {
+		return "", ErrInvalidWiki
+	}
+
+	err = validateWiki(bytes.NewReader(content))
 	if err != nil {
-		fmt.Fprintln(w, "Couldn't upload the file!")
-		log.Printf("Error while syncing '%v': %v\n", wikipath, err)
-		return
+		return "", err
 	}
 
-	evtHandler.Handle("poststore", wikiname)
+	storeLock.Lock()
+	defer storeLock.Unlock()
 
-	fmt.Fprintf(w, "0 - File successfully loaded in '%v'\n", wikiname)
-	log.Printf("Successfully uploaded: '%v'\n", wikiname)
+	if cfg().ForceOverwrite {
+		ifMatch = ""
+	}
+
+	// The store checks it again while saving,
+	// but a stale wiki shouldn't fire any events
+	if ifMatch != "" {
+		etag, err := wikiETag(wikiname)
+		if err != nil {
+			return "", err
+		}
+
+		if !matchETag(ifMatch, etag) {
+			return "", ErrWikiChanged
+		}
+	}
+
+	evtHandler.Handle("prestore", wikiname, user)
+
+	handleBackup(wikiname)
+
+	etag, err := saveWikiAs(wikiStore(), wikiname, bytes.NewReader(content), ifMatch, user)
+	if err != nil {
+		return "", err
+	}
+
+	handlePrune(wikiname)
+
+	evtHandler.Handle("poststore", wikiname, user)
+
+	return etag, nil
+}
+
+// createWiki stores a new wiki, or fails with ErrWikiExists. It's checked
+// under the store lock, so a wiki created or saved meanwhile isn't replaced.
+func createWiki(wikiname string, content []byte, user string) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if isWiki(wikiname) {
+		return ErrWikiExists
+	}
+
+	_, err := saveWikiAs(wikiStore(), wikiname, bytes.NewReader(content), "", user)
+
+	return err
 }
 
 func newWiki(w http.ResponseWriter, r *http.Request) {
@@ -263,22 +470,23 @@ func newWiki(w http.ResponseWriter, r *http.Request) {
 	}
 
 	wikiname = wikiname + ".html"
-	wikipath := filepath.Join(cfg.WikiDir, wikiname)
 
-	if isExist(wikipath) {
-		http.Error(w, "It already exists!", http.StatusBadRequest)
+	user, ok := authorize(w, r, wikiname, RoleWrite)
+	if !ok {
 		return
 	}
 
-	err = checkWikiDir()
-	if err != nil {
-		fmt.Fprintln(w, "Couldn't create the wiki!")
-		log.Printf("Error while creating '%v': %v\n", cfg.WikiDir, err)
+	if isWiki(wikiname) {
+		http.Error(w, "It already exists!", http.StatusBadRequest)
 		return
 	}
 
 	if wikitemplate == "Latest" {
-		err = downloadFile(wikipath, "http://tiddlywiki.com/empty.html")
+		err = downloadWiki(wikiname, "http://tiddlywiki.com/empty.html", user)
+		if err == ErrWikiExists {
+			http.Error(w, "It already exists!", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Couldn't download an empty wiki!", http.StatusInternalServerError)
 			log.Println("Error while downloading empty wiki:", err)
@@ -291,7 +499,11 @@ func newWiki(w http.ResponseWriter, r *http.Request) {
 
 	wikititle := r.FormValue("wikititle")
 
-	err = renderTemplate(wikitemplate, wikiname, wikititle)
+	err = renderTemplate(wikitemplate, wikiname, wikititle, user)
+	if err == ErrWikiExists {
+		http.Error(w, "It already exists!", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Couldn't render the template!", http.StatusInternalServerError)
 		log.Println("Error while rendering the template:", err)
@@ -301,9 +513,9 @@ func newWiki(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Success!")
 }
 
-func renderTemplate(wikitemplate string, wikiname string, wikititle string) error {
+func renderTemplate(wikitemplate string, wikiname string, wikititle string, user string) error {
 	// Open template file
-	tplpath := filepath.Join(cfg.TemplateDir, wikitemplate)
+	tplpath := filepath.Join(cfg().TemplateDir, wikitemplate)
 	tplf, err := os.Open(tplpath)
 	if err != nil {
 		return err
@@ -312,15 +524,7 @@ func renderTemplate(wikitemplate string, wikiname string, wikititle string) erro
 
 	r := bufio.NewReader(tplf)
 
-	// Open wiki file
-	wikipath := filepath.Join(cfg.WikiDir, wikiname)
-	wikif, err := os.Create(wikipath)
-	if err != nil {
-		return err
-	}
-	defer wikif.Close()
-
-	w := bufio.NewWriter(wikif)
+	var wiki bytes.Buffer
 
 	for {
 		// read a line
@@ -334,18 +538,12 @@ func renderTemplate(wikitemplate string, wikiname string, wikititle string) erro
 
 		line = strings.Replace(line, "<!--## Title ##-->", wikititle, -1)
 		line = strings.Replace(line, "<!--## Wikiname ##-->", wikiname, -1)
-		line = strings.Replace(line, "<!--## Username ##-->", cfg.Username, -1)
+		line = strings.Replace(line, "<!--## Username ##-->", user, -1)
 		line = strings.Replace(line, "<!--## StoreURL ##-->", serverURL+"/store", -1)
 
 		// write a line
-		if _, err := w.WriteString(line); err != nil {
-			return err
-		}
-	}
-
-	if err = w.Flush(); err != nil {
-		return err
+		wiki.WriteString(line)
 	}
 
-	return nil
+	return createWiki(wikiname, wiki.Bytes(), user)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+// TestPutSaver saves a wiki like TiddlyWiki5's PUT saver does
+func TestPutSaver(t *testing.T) {
+	store, events := useTestServer(t)
+	router := getRouter()
+
+	original := readTestTemplate(t)
+
+	wiki, err := tiddlywiki.Parse(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiddler := tiddlywiki.NewTiddler("Saved")
+	tiddler.SetField("text", "with the PUT saver")
+	wiki.Put(tiddler)
+
+	changed, err := wiki.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldETag, newETag := contentETag(original), contentETag(changed)
+
+	// The saver is only used if the wiki's URL says it can be saved in place
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/notes.html", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("DAV") == "" || !strings.Contains(rec.Header().Get("Allow"), "PUT") {
+		t.Fatalf("options: status = %v, header = %v", rec.Code, rec.Header())
+	}
+
+	// It remembers the ETag of the loaded wiki
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/notes.html", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != oldETag {
+		t.Fatalf("get: status = %v, etag = %v, want %v", rec.Code, rec.Header().Get("ETag"), oldETag)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		ifMatch string
+		auth    bool
+		status  int
+		etag    string
+		events  []string
+		content []byte
+	}{
+		{
+			name:    "without a login",
+			body:    string(changed),
+			ifMatch: oldETag,
+			status:  http.StatusUnauthorized,
+			content: original,
+		},
+		{
+			name:    "stale",
+			body:    string(changed),
+			ifMatch: `"stale"`,
+			auth:    true,
+			status:  http.StatusPreconditionFailed,
+			content: original,
+		},
+		{
+			name:    "not a wiki",
+			body:    "<html><body>Hello</body></html>",
+			ifMatch: oldETag,
+			auth:    true,
+			status:  http.StatusBadRequest,
+			content: original,
+		},
+		{
+			name:    "empty",
+			ifMatch: oldETag,
+			auth:    true,
+			status:  http.StatusBadRequest,
+			content: original,
+		},
+		{
+			name:    "saved",
+			body:    string(changed),
+			ifMatch: oldETag,
+			auth:    true,
+			status:  http.StatusNoContent,
+			etag:    newETag,
+			events:  []string{"prestore", "poststore"},
+			content: changed,
+		},
+		{
+			name:    "saved with the old ETag",
+			body:    string(original),
+			ifMatch: oldETag,
+			auth:    true,
+			status:  http.StatusPreconditionFailed,
+			content: changed,
+		},
+		{
+			name:    "saved without an ETag",
+			body:    string(original),
+			auth:    true,
+			status:  http.StatusNoContent,
+			etag:    oldETag,
+			events:  []string{"prestore", "poststore"},
+			content: original,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*events = []string{}
+
+			req := httptest.NewRequest("PUT", "/notes.html", strings.NewReader(test.body))
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			if test.auth {
+				req.SetBasicAuth("tiddlygo", "tiddlygo")
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", rec.Code, test.status, rec.Body.String())
+			}
+
+			if etag := rec.Header().Get("ETag"); etag != test.etag {
+				t.Fatalf("etag = %v, want %v", etag, test.etag)
+			}
+
+			if strings.Join(*events, ",") != strings.Join(test.events, ",") {
+				t.Fatalf("events = %v, want %v", *events, test.events)
+			}
+
+			store.lock.Lock()
+			content := store.wikis["notes.html"]
+			store.lock.Unlock()
+
+			if string(content) != string(test.content) {
+				t.Fatal("the stored wiki isn't the expected one")
+			}
+		})
+	}
+}
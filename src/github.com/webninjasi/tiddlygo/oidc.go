@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const c_oidcCallback = "/login/oidc/callback"
+
+// The state of a login is also kept in a cookie, so a login started by
+// someone else can't be finished in the browser of the user
+const c_oidcCookie = "tiddlygo_oidc"
+
+// A login has to be finished at the identity provider within this time
+const c_oidcLoginTimeout = 10 * time.Minute
+
+// The users of the provider are named with this prefix, which the names of
+// the user file can't have, so they can't be taken for local users
+const c_oidcUserPrefix = "oidc:"
+
+type OIDCConfig struct {
+	Issuer       string            `json:"issuer"`
+	ClientID     string            `json:"clientid"`
+	ClientSecret string            `json:"clientsecret"`
+	RedirectURL  string            `json:"redirecturl"`
+	Scopes       []string          `json:"scopes"`
+	UserClaim    string            `json:"userclaim"`
+	GroupsClaim  string            `json:"groupsclaim"`
+	Groups       map[string]string `json:"groups"`
+}
+
+// oidcLogin is a login which went to the identity provider
+type oidcLogin struct {
+	Verifier string
+	Nonce    string
+	Next     string
+	Expires  time.Time
+}
+
+var oidcLogins = struct {
+	sync.Mutex
+	byState map[string]oidcLogin
+}{byState: map[string]oidcLogin{}}
+
+// The provider is discovered on the first login, so the server starts
+// even if it can't be reached, and again if the issuer is changed
+var oidcClient = struct {
+	sync.Mutex
+	issuer   string
+	provider *oidc.Provider
+}{}
+
+func NewOIDCConfig() OIDCConfig {
+	return OIDCConfig{
+		Issuer:      "",
+		Scopes:      []string{oidc.ScopeOpenID, "profile", "email"},
+		UserClaim:   "preferred_username",
+		GroupsClaim: "groups",
+		Groups:      map[string]string{},
+	}
+}
+
+// Enabled reports whether logging in with the identity provider is set up
+func (this OIDCConfig) Enabled() bool {
+	return this.Issuer != "" && this.ClientID != ""
+}
+
+func oidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcClient.Lock()
+	defer oidcClient.Unlock()
+
+	issuer := cfg().OIDC.Issuer
+
+	if oidcClient.provider != nil && oidcClient.issuer == issuer {
+		return oidcClient.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	oidcClient.issuer = issuer
+	oidcClient.provider = provider
+
+	return provider, nil
+}
+
+// oauth2Config returns the client settings, the redirect URL is made from
+// the address of the request unless it's given
+func oauth2Config(r *http.Request, provider *oidc.Provider) *oauth2.Config {
+	conf := cfg().OIDC
+
+	redirectURL := conf.RedirectURL
+	if redirectURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		redirectURL = scheme + "://" + r.Host + c_oidcCallback
+	}
+
+	return &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       conf.Scopes,
+	}
+}
+
+// loginOIDC sends the browser to the identity provider
+func loginOIDC(w http.ResponseWriter, r *http.Request) {
+	if !cfg().OIDC.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	provider, err := oidcProvider(r.Context())
+	if err != nil {
+		http.Error(w, "Couldn't reach the identity provider!", http.StatusBadGateway)
+		log.Println("Error while discovering the identity provider:", err)
+		return
+	}
+
+	state, err := randomToken()
+	if err == nil {
+		var nonce string
+
+		nonce, err = randomToken()
+		if err == nil {
+			login := oidcLogin{
+				Verifier: oauth2.GenerateVerifier(),
+				Nonce:    nonce,
+				Next:     localURL(r.FormValue("next")),
+				Expires:  time.Now().Add(c_oidcLoginTimeout),
+			}
+
+			oidcLogins.Lock()
+			for state, l := range oidcLogins.byState {
+				if time.Now().After(l.Expires) {
+					delete(oidcLogins.byState, state)
+				}
+			}
+			oidcLogins.byState[state] = login
+			oidcLogins.Unlock()
+
+			setOIDCCookie(w, r, state, login.Expires)
+
+			authURL := oauth2Config(r, provider).AuthCodeURL(state,
+				oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+
+			http.Redirect(w, r, authURL, http.StatusFound)
+			return
+		}
+	}
+
+	http.Error(w, "Couldn't log in!", http.StatusInternalServerError)
+	log.Println("Error while starting a login:", err)
+}
+
+// oidcCallback finishes a login when the identity provider sends the
+// browser back, the user gets a session like with a password
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if !cfg().OIDC.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	setOIDCCookie(w, r, "", time.Unix(0, 0))
+
+	session, next, err := finishOIDCLogin(r)
+	if err != nil {
+		log.Printf("Failed login with the identity provider from %v: %v\n", r.RemoteAddr, err)
+		http.Redirect(w, r, "/login?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("Logged in '%v' with the identity provider\n", session.User)
+	startSession(w, r, session, next)
+}
+
+func finishOIDCLogin(r *http.Request) (*Session, string, error) {
+	conf := cfg().OIDC
+
+	state := r.FormValue("state")
+
+	oidcLogins.Lock()
+	login, ok := oidcLogins.byState[state]
+	delete(oidcLogins.byState, state)
+	oidcLogins.Unlock()
+
+	if !ok || time.Now().After(login.Expires) {
+		return nil, "/", fmt.Errorf("unknown or expired login")
+	}
+
+	if cookie, err := r.Cookie(c_oidcCookie); err != nil || cookie.Value != state {
+		return nil, login.Next, fmt.Errorf("the login was started in another browser")
+	}
+
+	if msg := r.FormValue("error"); msg != "" {
+		return nil, login.Next, fmt.Errorf("%v: %v", msg, r.FormValue("error_description"))
+	}
+
+	provider, err := oidcProvider(r.Context())
+	if err != nil {
+		return nil, login.Next, err
+	}
+
+	token, err := oauth2Config(r, provider).Exchange(r.Context(), r.FormValue("code"),
+		oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return nil, login.Next, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, login.Next, fmt.Errorf("no id_token in the token response")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: conf.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return nil, login.Next, err
+	}
+
+	if idToken.Nonce != login.Nonce {
+		return nil, login.Next, fmt.Errorf("the nonce doesn't match")
+	}
+
+	claims := map[string]interface{}{}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, login.Next, err
+	}
+
+	user, _ := claims[conf.UserClaim].(string)
+	if !reUserName.MatchString(user) {
+		return nil, login.Next, fmt.Errorf("invalid user name '%v' in the claim '%v'", user, conf.UserClaim)
+	}
+
+	return &Session{
+		User:     c_oidcUserPrefix + user,
+		Groups:   oidcGroups(claims[conf.GroupsClaim]),
+		External: true,
+	}, login.Next, nil
+}
+
+// oidcGroups returns the ACL groups of the groups claim, the groups which
+// aren't in the mapping are dropped
+func oidcGroups(claim interface{}) []string {
+	names := []string{}
+
+	switch value := claim.(type) {
+	case string:
+		names = append(names, value)
+	case []interface{}:
+		for _, v := range value {
+			if name, ok := v.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	groups := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if group, ok := cfg().OIDC.Groups[name]; ok {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+func setOIDCCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c_oidcCookie,
+		Value:    value,
+		Path:     "/login/oidc",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   cfg().Session.SecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is an OpenID Connect provider with discovery, its keys and a
+// token endpoint, which checks the PKCE verifier of each code
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock  sync.Mutex
+	codes map[string]fakeCode
+}
+
+// fakeCode is an authorization code the provider gave out
+type fakeCode struct {
+	challenge   string
+	redirectURL string
+	claims      map[string]interface{}
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &fakeIssuer{
+		key:   key,
+		codes: map[string]fakeCode{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/keys", issuer.keys)
+	mux.HandleFunc("/token", issuer.token)
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (this *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                this.server.URL,
+		"authorization_endpoint":                this.server.URL + "/auth",
+		"token_endpoint":                        this.server.URL + "/token",
+		"jwks_uri":                              this.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (this *fakeIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(this.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(this.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (this *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	this.lock.Lock()
+	code, ok := this.codes[r.PostFormValue("code")]
+	delete(this.codes, r.PostFormValue("code"))
+	this.lock.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge ||
+		r.PostFormValue("redirect_uri") != code.redirectURL {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     this.sign(code.claims),
+	})
+}
+
+// sign makes an RS256 JWT of the claims
+func (this *fakeIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(data))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, this.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return data + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login goes through a login with the provider, which puts the claims
+// into the ID token after changing them with change
+func (this *fakeIssuer) login(t *testing.T, change func(claims map[string]interface{}, cookie *http.Cookie)) *httptest.ResponseRecorder {
+	router := getRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/login/oidc?next=/notes.html", nil))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status = %v: %v", rec.Code, rec.Body.String())
+	}
+
+	auth, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := auth.Query()
+
+	if !strings.HasPrefix(auth.String(), this.server.URL+"/auth?") {
+		t.Fatalf("the login went to %v", auth)
+	}
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("the login has no PKCE challenge: %v", auth)
+	}
+
+	if query.Get("client_id") != "tiddlygo" || query.Get("state") == "" || query.Get("nonce") == "" {
+		t.Fatalf("the login is missing a parameter: %v", auth)
+	}
+
+	var cookie *http.Cookie
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == c_oidcCookie {
+			cookie = c
+		}
+	}
+
+	if cookie == nil || cookie.Value != query.Get("state") {
+		t.Fatal("the state of the login isn't in a cookie")
+	}
+
+	claims := map[string]interface{}{
+		"iss":                this.server.URL,
+		"sub":                "1234",
+		"aud":                "tiddlygo",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              query.Get("nonce"),
+		"preferred_username": "alice",
+		"groups":             []string{"wiki-editors", "admins"},
+	}
+
+	if change != nil {
+		change(claims, cookie)
+	}
+
+	this.lock.Lock()
+	this.codes["code"] = fakeCode{query.Get("code_challenge"), query.Get("redirect_uri"), claims}
+	this.lock.Unlock()
+
+	callback := httptest.NewRequest("GET", c_oidcCallback+"?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	callback.AddCookie(cookie)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, callback)
+
+	return rec
+}
+
+// sessionOf returns the session a login response started
+func sessionOf(rec *httptest.ResponseRecorder) *Session {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == c_sessionCookie && c.Value != "" {
+			sessions.Lock()
+			defer sessions.Unlock()
+
+			return sessions.byId[c.Value]
+		}
+	}
+
+	return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useTestServer(t)
+	issuer := newFakeIssuer(t)
+
+	conf := *cfg()
+	conf.OIDC = NewOIDCConfig()
+	conf.OIDC.Issuer = issuer.server.URL
+	conf.OIDC.ClientID = "tiddlygo"
+	conf.OIDC.ClientSecret = "secret"
+	conf.OIDC.Groups = map[string]string{"wiki-editors": "team"}
+	setConfig(&conf)
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{}, cookie *http.Cookie)
+		user   string
+	}{
+		{
+			name: "login",
+			user: "oidc:alice",
+		},
+		{
+			name: "wrong nonce",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["nonce"] = "wrong"
+			},
+		},
+		{
+			name: "token of another client",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["aud"] = "other"
+			},
+		},
+		{
+			name: "token of another issuer",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["iss"] = "http://other.example"
+			},
+		},
+		{
+			name: "expired token",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			},
+		},
+		{
+			name: "login started in another browser",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				cookie.Value = "other"
+			},
+		},
+		{
+			name: "invalid user name",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["preferred_username"] = "alice smith"
+			},
+		},
+		{
+			name: "local user name",
+			change: func(claims map[string]interface{}, cookie *http.Cookie) {
+				claims["preferred_username"] = "tiddlygo"
+			},
+			user: "oidc:tiddlygo",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := issuer.login(t, test.change)
+
+			if rec.Code != http.StatusSeeOther {
+				t.Fatalf("callback: status = %v: %v", rec.Code, rec.Body.String())
+			}
+
+			session := sessionOf(rec)
+
+			if test.user == "" {
+				if session != nil {
+					t.Fatalf("a session of %v was started", session.User)
+				}
+
+				if location := rec.Header().Get("Location"); !strings.HasPrefix(location, "/login?error=1") {
+					t.Fatalf("went to %v, want the login page", location)
+				}
+				return
+			}
+
+			if session == nil {
+				t.Fatalf("no session was started, went to %v", rec.Header().Get("Location"))
+			}
+
+			if rec.Header().Get("Location") != "/notes.html" {
+				t.Fatalf("went to %v, want /notes.html", rec.Header().Get("Location"))
+			}
+
+			if session.User != test.user || !session.External {
+				t.Fatalf("session of %v (external %v), want %v", session.User, session.External, test.user)
+			}
+
+			// Only the mapped groups are kept
+			if strings.Join(session.Groups, ",") != "team" {
+				t.Fatalf("groups = %v, want [team]", session.Groups)
+			}
+		})
+	}
+}
+
+// A code can't be used without the verifier of the login which asked for it
+func TestOIDCLoginWithoutVerifier(t *testing.T) {
+	useTestServer(t)
+	issuer := newFakeIssuer(t)
+
+	conf := *cfg()
+	conf.OIDC = NewOIDCConfig()
+	conf.OIDC.Issuer = issuer.server.URL
+	conf.OIDC.ClientID = "tiddlygo"
+	setConfig(&conf)
+
+	router := getRouter()
+
+	start := httptest.NewRecorder()
+	router.ServeHTTP(start, httptest.NewRequest("GET", "/login/oidc", nil))
+
+	auth, err := url.Parse(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := auth.Query().Get("state")
+
+	// The code was given out to a login with another verifier
+	sum := sha256.Sum256([]byte("another verifier"))
+
+	issuer.lock.Lock()
+	issuer.codes["stolen"] = fakeCode{
+		base64.RawURLEncoding.EncodeToString(sum[:]),
+		auth.Query().Get("redirect_uri"),
+		map[string]interface{}{
+			"iss":                issuer.server.URL,
+			"sub":                "1234",
+			"aud":                "tiddlygo",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"nonce":              auth.Query().Get("nonce"),
+			"preferred_username": "mallory",
+		},
+	}
+	issuer.lock.Unlock()
+
+	callback := httptest.NewRequest("GET", c_oidcCallback+"?code=stolen&state="+url.QueryEscape(state), nil)
+	callback.AddCookie(&http.Cookie{Name: c_oidcCookie, Value: state})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, callback)
+
+	if session := sessionOf(rec); session != nil {
+		t.Fatalf("a session of %v was started with the code of another login", session.User)
+	}
+
+	if location := rec.Header().Get("Location"); !strings.HasPrefix(location, "/login?error=1") {
+		t.Fatalf("went to %v, want the login page", location)
+	}
+}
+
+func TestOIDCGroups(t *testing.T) {
+	conf := *cfg()
+	conf.OIDC.Groups = map[string]string{"wiki-editors": "team", "wiki-admins": "admins"}
+	old := cfg()
+	setConfig(&conf)
+	defer setConfig(old)
+
+	tests := []struct {
+		claim  interface{}
+		groups string
+	}{
+		{nil, ""},
+		{"wiki-editors", "team"},
+		{"other", ""},
+		{[]interface{}{"wiki-admins", "other", 1, "wiki-editors"}, "admins,team"},
+	}
+
+	for _, test := range tests {
+		if groups := strings.Join(oidcGroups(test.claim), ","); groups != test.groups {
+			t.Errorf("groups of %v = %q, want %q", test.claim, groups, test.groups)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the config file is checked for changes
+const c_configPollInterval = 2 * time.Second
+
+// These settings are only used to start the server and open the storage,
+// changing them needs a restart
+var startupKeys = []string{"address", "tls", "storage", "s3", "database"}
+
+// The values of these settings aren't written into the log
+var secretKeys = map[string]bool{
+	"password":           true,
+	"s3.accesskey":       true,
+	"s3.secretkey":       true,
+	"oidc.clientsecret":  true,
+	"git.remotepassword": true,
+}
+
+// reloadLock keeps two reloads from running at once
+var reloadLock sync.Mutex
+
+// watchConfig reloads the config file when it changes or on SIGHUP
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(c_configPollInterval)
+	defer ticker.Stop()
+
+	modTime, size := statConfig()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading the config on SIGHUP")
+		case <-ticker.C:
+			newModTime, newSize := statConfig()
+			if newModTime.Equal(modTime) && newSize == size {
+				continue
+			}
+		}
+
+		modTime, size = statConfig()
+
+		err := reloadConfig()
+		if err != nil {
+			log.Println("Error while reloading the config, keeping the old one:", err)
+		}
+	}
+}
+
+func statConfig() (time.Time, int64) {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}, 0
+	}
+
+	return info.ModTime(), info.Size()
+}
+
+// reloadConfig reads the config file again, with the environment variables
+// and the flags applied over it, and replaces the current config
+// and the event actions with it unless it's invalid
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+
+	old := cfg()
+
+	changes, err := configChanges(old, conf)
+	if err != nil {
+		return err
+	}
+
+	keepStartupSettings(conf, old)
+
+	// A new wikidir is opened as the store of the files, the wikis which are
+	// in the old one aren't moved there
+	var store WikiStore
+
+	if conf.WikiDir != old.WikiDir {
+		err = os.MkdirAll(conf.WikiDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := wikiStore().(*FileStore); ok {
+			store = NewFileStore(conf.WikiDir, conf.Storage)
+		}
+	}
+
+	evtHandler.Parse(conf.Events)
+	setConfig(conf)
+
+	if store != nil {
+		setWikiStore(store)
+	}
+
+	if len(changes) == 0 {
+		log.Println("Reloaded the config, nothing has changed")
+		return nil
+	}
+
+	for _, change := range changes {
+		log.Println("Reloaded the config:", change)
+	}
+
+	return nil
+}
+
+// keepStartupSettings keeps the old values of the settings which need a restart,
+// so the config still matches the running server
+func keepStartupSettings(conf *Config, old *Config) {
+	conf.Address = old.Address
+	conf.TLS = old.TLS
+	conf.Storage = old.Storage
+	conf.S3 = old.S3
+	conf.Database = old.Database
+}
+
+// configChanges describes every setting which differs between the configs
+func configChanges(old *Config, conf *Config) ([]string, error) {
+	oldValues, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+
+	newValues, err := flattenConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The values are logged as print-config shows them, e.g. without the
+	// password of the git remote
+	oldShown, err := flattenConfig(old.Redacted())
+	if err != nil {
+		return nil, err
+	}
+
+	newShown, err := flattenConfig(conf.Redacted())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+
+	for key := range oldValues {
+		keys = append(keys, key)
+	}
+
+	for key := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	changes := []string{}
+
+	for _, key := range keys {
+		oldValue, hadOld := oldValues[key]
+		newValue, hasNew := newValues[key]
+
+		if hadOld && hasNew && oldValue == newValue {
+			continue
+		}
+
+		oldValue, newValue = oldShown[key], newShown[key]
+
+		if !hadOld {
+			oldValue = "(none)"
+		}
+
+		if !hasNew {
+			newValue = "(none)"
+		}
+
+		switch {
+		case isStartupKey(key):
+			changes = append(changes, key+" needs a restart to change")
+		case secretKeys[key]:
+			changes = append(changes, key+" has changed")
+		default:
+			changes = append(changes, key+" has changed from "+oldValue+" to "+newValue)
+		}
+	}
+
+	return changes, nil
+}
+
+func isStartupKey(key string) bool {
+	for _, startupKey := range startupKeys {
+		if key == startupKey || strings.HasPrefix(key, startupKey+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flattenConfig returns the JSON values of the settings by their dotted keys,
+// e.g. "backup.keeplast"
+func flattenConfig(conf *Config) (map[string]string, error) {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	flattenJSON("", tree, values)
+
+	return values, nil
+}
+
+func flattenJSON(prefix string, value interface{}, values map[string]string) {
+	if obj, ok := value.(map[string]interface{}); ok {
+		for key, v := range obj {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+
+			flattenJSON(key, v, values)
+		}
+
+		return
+	}
+
+	data, _ := json.Marshal(value)
+	values[prefix] = string(data)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const c_storageS3 = "s3"
+
+// The content hash is kept along with the object, since the ETag of S3
+// isn't a hash of the content for every upload
+const c_s3HashMeta = "Sha1"
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	Region    string `json:"region"`
+	AccessKey string `json:"accesskey"`
+	SecretKey string `json:"secretkey"`
+	Secure    bool   `json:"secure"`
+}
+
+func NewS3Config() S3Config {
+	return S3Config{
+		Endpoint: "s3.amazonaws.com",
+		Bucket:   "",
+		Prefix:   "",
+		Secure:   true,
+	}
+}
+
+// S3Store keeps every wiki as an object in a bucket of an S3 compatible
+// object storage, e.g. AWS S3 or MinIO
+type S3Store struct {
+	Bucket string
+	Prefix string
+
+	client *minio.Client
+	lock   sync.Mutex
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket is given for the s3 storage")
+	}
+
+	// Without keys in the config, they are looked up like the AWS tools do
+	creds := credentials.NewStaticV4(config.AccessKey, config.SecretKey, "")
+	if config.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: config.Secure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(context.Background(), config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("the bucket '%v' doesn't exist", config.Bucket)
+	}
+
+	prefix := config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &S3Store{
+		Bucket: config.Bucket,
+		Prefix: prefix,
+		client: client,
+	}, nil
+}
+
+// key returns the object key of a wiki
+func (this *S3Store) key(name string) string {
+	return this.Prefix + name
+}
+
+// s3Error converts the errors of S3 which have a meaning for the wikis
+func s3Error(op string, key string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey":
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	case "PreconditionFailed":
+		return ErrWikiChanged
+	}
+
+	return err
+}
+
+func (this *S3Store) List() ([]WikiInfo, error) {
+	wikis := []WikiInfo{}
+
+	objects := this.client.ListObjects(context.Background(), this.Bucket, minio.ListObjectsOptions{
+		Prefix: this.Prefix,
+	})
+
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		name := strings.TrimPrefix(obj.Key, this.Prefix)
+
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".html") {
+			continue
+		}
+
+		wikis = append(wikis, WikiInfo{name, obj.Size, obj.LastModified})
+	}
+
+	sort.Slice(wikis, func(i, j int) bool {
+		return wikis[i].Name < wikis[j].Name
+	})
+
+	return wikis, nil
+}
+
+func (this *S3Store) stat(name string) (minio.ObjectInfo, error) {
+	info, err := this.client.StatObject(context.Background(), this.Bucket, this.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return info, s3Error("stat", this.key(name), err)
+	}
+
+	return info, nil
+}
+
+func (this *S3Store) Stat(name string) (WikiInfo, error) {
+	info, err := this.stat(name)
+	if err != nil {
+		return WikiInfo{}, err
+	}
+
+	return WikiInfo{name, info.Size, info.LastModified}, nil
+}
+
+func (this *S3Store) Open(name string) (io.ReadCloser, error) {
+	obj, err := this.client.GetObject(context.Background(), this.Bucket, this.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error("open", this.key(name), err)
+	}
+
+	// The request is only sent once the object is used
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s3Error("open", this.key(name), err)
+	}
+
+	return obj, nil
+}
+
+// etag returns the ETag of a wiki from its object info, the content is only
+// hashed if the object was uploaded by something else
+func (this *S3Store) etag(name string, info minio.ObjectInfo) (string, error) {
+	if sum := info.UserMetadata[c_s3HashMeta]; sum != "" {
+		return `"` + sum + `"`, nil
+	}
+
+	f, err := this.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hashETag(hash), nil
+}
+
+// Save writes the wiki with a single request, which S3 applies at once.
+// The bucket refuses the write if another server has changed the wiki after
+// it was checked here, or has created it if it didn't exist yet.
+func (this *S3Store) Save(name string, r io.Reader, ifMatch string) (string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(content)
+
+	opts := minio.PutObjectOptions{
+		ContentType:      "text/html; charset=utf-8",
+		UserMetadata:     map[string]string{c_s3HashMeta: hex.EncodeToString(sum[:])},
+		DisableMultipart: true,
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	info, err := this.stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	exists := err == nil
+
+	if ifMatch != "" {
+		etag := ""
+
+		if exists {
+			etag, err = this.etag(name, info)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if !matchETag(ifMatch, etag) {
+			return "", ErrWikiChanged
+		}
+
+		opts.SetMatchETag(info.ETag)
+	} else if !exists {
+		opts.SetMatchETagExcept("*")
+	}
+
+	_, err = this.client.PutObject(context.Background(), this.Bucket, this.key(name),
+		bytes.NewReader(content), int64(len(content)), opts)
+	if err != nil {
+		return "", s3Error("save", this.key(name), err)
+	}
+
+	return contentETag(content), nil
+}
+
+func (this *S3Store) Delete(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// Removing a missing object isn't an error for S3
+	_, err := this.stat(name)
+	if err != nil {
+		return err
+	}
+
+	err = this.client.RemoveObject(context.Background(), this.Bucket, this.key(name), minio.RemoveObjectOptions{})
+	if err != nil {
+		return s3Error("delete", this.key(name), err)
+	}
+
+	return nil
+}
+
+// Rename copies the object to the new name and removes the old one,
+// since S3 can't move objects
+func (this *S3Store) Rename(oldname string, newname string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	info, err := this.stat(oldname)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.stat(newname)
+	if err == nil {
+		return ErrWikiExists
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = this.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: this.Bucket, Object: this.key(newname)},
+		minio.CopySrcOptions{Bucket: this.Bucket, Object: this.key(oldname), MatchETag: info.ETag})
+	if err != nil {
+		return s3Error("rename", this.key(oldname), err)
+	}
+
+	err = this.client.RemoveObject(context.Background(), this.Bucket, this.key(oldname), minio.RemoveObjectOptions{})
+	if err != nil {
+		return s3Error("rename", this.key(oldname), err)
+	}
+
+	return nil
+}
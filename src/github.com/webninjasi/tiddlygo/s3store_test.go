@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Object is an object of the fake bucket
+type fakeS3Object struct {
+	content []byte
+	meta    http.Header
+	etag    string
+}
+
+// fakeS3 is enough of the S3 API for the S3Store: a single bucket with
+// path-style requests and the conditions of PUT
+type fakeS3 struct {
+	lock    sync.Mutex
+	bucket  string
+	objects map[string]fakeS3Object
+
+	// conditions has the If-Match and If-None-Match header of every PUT
+	conditions []string
+
+	// beforePut runs before a PUT is checked, e.g. to change the object
+	beforePut func()
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string]fakeS3Object{},
+	}
+}
+
+func (this *fakeS3) put(key string, content []byte, meta http.Header) {
+	sum := md5.Sum(content)
+
+	this.objects[key] = fakeS3Object{content, meta, `"` + hex.EncodeToString(sum[:]) + `"`}
+}
+
+func (this *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		bucket, key = path[:idx], path[idx+1:]
+	}
+
+	if bucket != this.bucket {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	if r.Method == "PUT" && this.beforePut != nil {
+		this.beforePut()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch {
+	case key == "" && r.Method == "HEAD":
+	case key == "" && r.Method == "GET":
+		this.list(w, r.URL.Query())
+	case r.Method == "HEAD" || r.Method == "GET":
+		obj, ok := this.objects[key]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		for name, values := range obj.meta {
+			w.Header()[name] = values
+		}
+
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.content)))
+		w.Header().Set("Last-Modified", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+
+		if r.Method == "GET" {
+			w.Write(obj.content)
+		}
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), this.bucket+"/")
+
+		obj, ok := this.objects[source]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && `"`+strings.Trim(match, `"`)+`"` != obj.etag {
+			s3ErrorResponse(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		this.put(key, obj.content, obj.meta)
+
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%v</ETag><LastModified>2024-01-01T00:00:00.000Z</LastModified></CopyObjectResult>`, obj.etag)
+	case r.Method == "PUT":
+		content, err := readS3Body(r)
+		if err != nil {
+			s3ErrorResponse(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		this.conditions = append(this.conditions, "If-Match: "+ifMatch+", If-None-Match: "+ifNoneMatch)
+
+		obj, exists := this.objects[key]
+
+		if (ifMatch != "" && (!exists || ifMatch != obj.etag)) || (ifNoneMatch == "*" && exists) {
+			s3ErrorResponse(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		meta := http.Header{}
+
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				meta[name] = values
+			}
+		}
+
+		this.put(key, content, meta)
+
+		w.Header().Set("ETag", this.objects[key].etag)
+	case r.Method == "DELETE":
+		delete(this.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3ErrorResponse(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2, the keys below a "/" after the prefix are
+// only listed as common prefixes
+func (this *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+
+	type commonPrefix struct {
+		Prefix string
+	}
+
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{
+		Name:   this.bucket,
+		Prefix: query.Get("prefix"),
+	}
+
+	keys := []string{}
+	for key := range this.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, result.Prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(key, result.Prefix)
+
+		if idx := strings.Index(rest, "/"); idx >= 0 && query.Get("delimiter") == "/" {
+			prefix := result.Prefix + rest[:idx+1]
+			if !seen[prefix] {
+				seen[prefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{prefix})
+			}
+			continue
+		}
+
+		obj := this.objects[key]
+		result.Contents = append(result.Contents, content{key, "2024-01-01T00:00:00.000Z", obj.etag, len(obj.content)})
+	}
+
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Body reads the body of a PUT, which the client sends in signed
+// chunks over plain http
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var buf bytes.Buffer
+
+	reader := bufio.NewReader(r.Body)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.Split(line, ";")[0]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return buf.Bytes(), nil
+		}
+
+		_, err = io.CopyN(&buf, reader, size)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = reader.Discard(2)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%v</Code><Message>%v</Message></Error>`, code, code)
+}
+
+// newTestS3Store returns a store of the fake bucket "wikis"
+func newTestS3Store(t *testing.T, prefix string) (*S3Store, *fakeS3) {
+	fake := newFakeS3("wikis")
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "wikis",
+		Prefix:    prefix,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, fake
+}
+
+func readS3Wiki(t *testing.T, store *S3Store, name string) string {
+	f, err := store.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestS3StoreSave(t *testing.T) {
+	store, fake := newTestS3Store(t, "")
+
+	etag, err := store.Save("notes.html", strings.NewReader("one"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if etag != contentETag([]byte("one")) {
+		t.Fatalf("etag = %v, want %v", etag, contentETag([]byte("one")))
+	}
+
+	_, err = store.Save("notes.html", strings.NewReader("two"), `"stale"`)
+	if err != ErrWikiChanged {
+		t.Fatalf("save with a stale ETag: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	_, err = store.Save("missing.html", strings.NewReader("two"), etag)
+	if err != ErrWikiChanged {
+		t.Fatalf("save of a missing wiki with an ETag: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	etag, err = store.Save("notes.html", strings.NewReader("two"), etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readS3Wiki(t, store, "notes.html"); content != "two" {
+		t.Fatalf("content = %q, want %q", content, "two")
+	}
+
+	// The etag is taken from the hash in the metadata, without a download
+	info, err := store.stat("notes.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := store.etag("notes.html", info); got != etag {
+		t.Fatalf("stored etag = %v, want %v", got, etag)
+	}
+
+	// Another server writes between the check and the write
+	fake.beforePut = func() {
+		fake.lock.Lock()
+		fake.put("notes.html", []byte("other server"), http.Header{})
+		fake.lock.Unlock()
+	}
+
+	_, err = store.Save("notes.html", strings.NewReader("three"), etag)
+	if err != ErrWikiChanged {
+		t.Fatalf("save after another server's write: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	fake.beforePut = func() {
+		fake.lock.Lock()
+		fake.put("new.html", []byte("other server"), http.Header{})
+		fake.lock.Unlock()
+	}
+
+	_, err = store.Save("new.html", strings.NewReader("mine"), "")
+	if err != ErrWikiChanged {
+		t.Fatalf("save after another server created the wiki: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	fake.beforePut = nil
+
+	if content := readS3Wiki(t, store, "notes.html"); content != "other server" {
+		t.Fatalf("content = %q, want the other server's", content)
+	}
+
+	// A new wiki mustn't exist yet, an existing one must be the one checked
+	if fake.conditions[0] != "If-Match: , If-None-Match: *" {
+		t.Errorf("put of a new wiki: %v", fake.conditions[0])
+	}
+
+	if !strings.HasPrefix(fake.conditions[1], `If-Match: "`) || !strings.HasSuffix(fake.conditions[1], "If-None-Match: ") {
+		t.Errorf("put of an existing wiki: %v", fake.conditions[1])
+	}
+}
+
+func TestS3StoreRename(t *testing.T) {
+	store, fake := newTestS3Store(t, "wikis")
+
+	for _, name := range []string{"one.html", "two.html"} {
+		_, err := store.Save(name, strings.NewReader(name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.Rename("one.html", "two.html")
+	if err != ErrWikiExists {
+		t.Fatalf("rename onto another wiki: got %v, want %v", err, ErrWikiExists)
+	}
+
+	err = store.Rename("missing.html", "three.html")
+	if !os.IsNotExist(err) {
+		t.Fatalf("rename of a missing wiki: got %v, want a missing file", err)
+	}
+
+	err = store.Rename("one.html", "three.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fake.objects["wikis/one.html"]; ok {
+		t.Fatal("the old object is still there")
+	}
+
+	if content := readS3Wiki(t, store, "three.html"); content != "one.html" {
+		t.Fatalf("content = %q, want %q", content, "one.html")
+	}
+
+	// The hash is copied along with the object
+	info, err := store.stat("three.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.UserMetadata[c_s3HashMeta] == "" {
+		t.Fatal("the renamed wiki lost its hash")
+	}
+}
+
+func TestS3StoreList(t *testing.T) {
+	store, fake := newTestS3Store(t, "team/")
+
+	for _, key := range []string{"team/b.html", "team/a.html", "team/notes.txt", "team/old/c.html", "other/d.html", "e.html"} {
+		fake.put(key, []byte(key), http.Header{})
+	}
+
+	wikis, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, wiki := range wikis {
+		names = append(names, wiki.Name)
+	}
+
+	if strings.Join(names, ",") != "a.html,b.html" {
+		t.Fatalf("wikis = %v, want [a.html b.html]", names)
+	}
+
+	if wikis[0].Size != int64(len("team/a.html")) {
+		t.Fatalf("size = %v, want %v", wikis[0].Size, len("team/a.html"))
+	}
+
+	if err := store.Delete("a.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete("a.html"); !os.IsNotExist(err) {
+		t.Fatalf("delete of a missing wiki: got %v, want a missing file", err)
+	}
+
+	if _, err := store.Stat("a.html"); !os.IsNotExist(err) {
+		t.Fatalf("stat of a deleted wiki: got %v, want a missing file", err)
+	}
+}
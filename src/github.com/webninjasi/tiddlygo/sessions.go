@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const c_sessionCookie = "tiddlygo_session"
+
+type SessionConfig struct {
+	Lifetime     string `json:"lifetime"`
+	SecureCookie bool   `json:"securecookie"`
+}
+
+// Session is a login of the web UI, the CSRF token has to be sent back
+// with every request which changes something. External sessions are made
+// by an identity provider for users who aren't in the user file.
+type Session struct {
+	User     string
+	Groups   []string
+	External bool
+	CSRF     string
+	Expires  time.Time
+}
+
+// The sessions are kept by the server, the cookie only has a random id
+var sessions = struct {
+	sync.Mutex
+	byId map[string]*Session
+}{byId: map[string]*Session{}}
+
+func NewSessionConfig() SessionConfig {
+	return SessionConfig{
+		Lifetime:     "168h",
+		SecureCookie: false,
+	}
+}
+
+// sessionLifetime returns how long a login lasts, a week if it isn't valid
+func sessionLifetime() time.Duration {
+	lifetime, err := time.ParseDuration(cfg().Session.Lifetime)
+	if err != nil || lifetime <= 0 {
+		return 7 * 24 * time.Hour
+	}
+
+	return lifetime
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newSession starts a session and returns its id
+func newSession(session *Session) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	session.CSRF, err = randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	session.Expires = time.Now().Add(sessionLifetime())
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	// The expired sessions are dropped here, so they don't pile up
+	for id, s := range sessions.byId {
+		if time.Now().After(s.Expires) {
+			delete(sessions.byId, id)
+		}
+	}
+
+	sessions.byId[id] = session
+
+	return id, nil
+}
+
+// requestSession returns the session of the cookie of a request,
+// if it hasn't expired and its user still exists
+func requestSession(r *http.Request) (string, *Session, bool) {
+	cookie, err := r.Cookie(c_sessionCookie)
+	if err != nil {
+		return "", nil, false
+	}
+
+	sessions.Lock()
+	session, ok := sessions.byId[cookie.Value]
+	sessions.Unlock()
+
+	if !ok || time.Now().After(session.Expires) || (!session.External && !userExists(session.User)) {
+		return "", nil, false
+	}
+
+	return cookie.Value, session, true
+}
+
+func deleteSession(id string) {
+	sessions.Lock()
+	delete(sessions.byId, id)
+	sessions.Unlock()
+}
+
+// userExists reports whether a user can still log in
+func userExists(user string) bool {
+	users, err := loadUsers()
+	if err != nil {
+		log.Println("Error while reading the users:", err)
+		return false
+	}
+
+	if len(users.Users) == 0 {
+		return user == cfg().Username
+	}
+
+	_, ok := users.Users[user]
+
+	return ok
+}
+
+// isSafeMethod reports whether a request only reads
+func isSafeMethod(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+}
+
+// checkCSRF reports whether a request which changes something was sent by
+// the pages of the server. Other sites can't read the token. TiddlyWiki sends
+// X-Requested-With instead, which is only trusted along with the Origin or
+// Referer of a page of this server.
+func checkCSRF(r *http.Request, session *Session) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf")
+	}
+
+	if token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRF)) == 1
+	}
+
+	same, sent := requestOrigin(r)
+
+	return r.Header.Get("X-Requested-With") != "" && sent && same
+}
+
+// checkOrigin reports whether a request may use the credentials it has, which
+// browsers also send along with the requests of other sites. The requests
+// without an Origin or a Referer aren't sent by a page, e.g. the ones of curl.
+func checkOrigin(r *http.Request) bool {
+	same, sent := requestOrigin(r)
+
+	return same || !sent
+}
+
+// requestOrigin reports whether a request was sent by a page of this server
+// by its Origin header, or its Referer without one, and whether it has either
+func requestOrigin(r *http.Request) (bool, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+
+	if origin == "" {
+		return false, false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false, true
+	}
+
+	return strings.EqualFold(u.Host, r.Host), true
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c_sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   cfg().Session.SecureCookie || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// localURL returns the address to go back to after the login,
+// which must be on this server
+func localURL(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
+
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, filepath.Join(cfg().PublicDir, "login.html"))
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	// Otherwise a page of another site could log the browser in as its own user
+	if !checkOrigin(r) {
+		http.Error(w, "Logins from other sites aren't allowed!", http.StatusForbidden)
+		return
+	}
+
+	user := r.PostFormValue("username")
+	next := localURL(r.PostFormValue("next"))
+
+	if !checkCredentials(user, r.PostFormValue("password")) {
+		log.Printf("Failed login of '%v' from %v\n", user, r.RemoteAddr)
+		http.Redirect(w, r, "/login?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	startSession(w, r, &Session{User: user}, next)
+}
+
+// startSession logs the user of a session in and goes back to next
+func startSession(w http.ResponseWriter, r *http.Request, session *Session, next string) {
+	id, err := newSession(session)
+	if err != nil {
+		http.Error(w, "Couldn't log in!", http.StatusInternalServerError)
+		log.Println("Error while creating a session:", err)
+		return
+	}
+
+	setSessionCookie(w, r, id, session.Expires)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	id, session, ok := requestSession(r)
+	if ok {
+		if !checkCSRF(r, session) {
+			http.Error(w, "Invalid CSRF token!", http.StatusForbidden)
+			return
+		}
+
+		deleteSession(id)
+	}
+
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sessionStatus tells the web UI who is logged in, the CSRF token
+// to send with its changes and whether there is an identity provider
+func sessionStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"user": "",
+		"csrf": "",
+		"sso":  cfg().OIDC.Enabled(),
+	}
+
+	if _, session, ok := requestSession(r); ok {
+		status["user"] = session.User
+		status["csrf"] = session.CSRF
+	} else if user, pass, ok := r.BasicAuth(); ok && checkCredentials(user, pass) {
+		status["user"] = user
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const c_storageSQLite = "sqlite"
+
+// The times are kept in the format SQLite's date functions understand
+const c_sqliteTimeFormat = "2006-01-02 15:04:05.000"
+
+// Every saved content is kept once in contents, the revisions refer to it
+// by its SHA-1 and wikis points each wiki to its current revision
+const c_sqliteSchema = `
+CREATE TABLE IF NOT EXISTS contents (
+	hash TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS revisions (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	wiki   TEXT NOT NULL,
+	hash   TEXT NOT NULL REFERENCES contents (hash),
+	size   INTEGER NOT NULL,
+	author TEXT NOT NULL,
+	time   TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS revisions_wiki ON revisions (wiki, id);
+
+CREATE TABLE IF NOT EXISTS wikis (
+	name     TEXT PRIMARY KEY,
+	revision INTEGER NOT NULL REFERENCES revisions (id)
+);
+`
+
+// SQLiteStore keeps the wikis and every revision of them in a single
+// SQLite database file
+type SQLiteStore struct {
+	Path string
+
+	db   *sql.DB
+	lock sync.Mutex
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// A single connection is enough and keeps the writes in order
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(c_sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		Path: path,
+		db:   db,
+	}, nil
+}
+
+// sqliteError converts a missing row into an error about a missing wiki
+func sqliteError(op string, name string, err error) error {
+	if err == sql.ErrNoRows {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+
+	return err
+}
+
+func parseSQLiteTime(value string) time.Time {
+	t, _ := time.ParseInLocation(c_sqliteTimeFormat, value, time.UTC)
+	return t
+}
+
+func (this *SQLiteStore) List() ([]WikiInfo, error) {
+	rows, err := this.db.Query(`SELECT w.name, r.size, r.time FROM wikis w
+		JOIN revisions r ON r.id = w.revision ORDER BY w.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	wikis := []WikiInfo{}
+
+	for rows.Next() {
+		var wiki WikiInfo
+		var modTime string
+
+		err = rows.Scan(&wiki.Name, &wiki.Size, &modTime)
+		if err != nil {
+			return nil, err
+		}
+
+		wiki.ModTime = parseSQLiteTime(modTime)
+		wikis = append(wikis, wiki)
+	}
+
+	return wikis, rows.Err()
+}
+
+func (this *SQLiteStore) Stat(name string) (WikiInfo, error) {
+	wiki := WikiInfo{Name: name}
+	var modTime string
+
+	err := this.db.QueryRow(`SELECT r.size, r.time FROM wikis w
+		JOIN revisions r ON r.id = w.revision WHERE w.name = ?`, name).Scan(&wiki.Size, &modTime)
+	if err != nil {
+		return WikiInfo{}, sqliteError("stat", name, err)
+	}
+
+	wiki.ModTime = parseSQLiteTime(modTime)
+
+	return wiki, nil
+}
+
+func (this *SQLiteStore) Open(name string) (io.ReadCloser, error) {
+	var content []byte
+
+	err := this.db.QueryRow(`SELECT c.data FROM wikis w
+		JOIN revisions r ON r.id = w.revision
+		JOIN contents c ON c.hash = r.hash WHERE w.name = ?`, name).Scan(&content)
+	if err != nil {
+		return nil, sqliteError("open", name, err)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (this *SQLiteStore) Save(name string, r io.Reader, ifMatch string) (string, error) {
+	return this.SaveAs(name, r, ifMatch, "")
+}
+
+// SaveAs adds a new revision of the wiki and makes it the current one
+func (this *SQLiteStore) SaveAs(name string, r io.Reader, ifMatch string, author string) (string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(content)
+	hash := hex.EncodeToString(sum[:])
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if ifMatch != "" {
+		var current string
+
+		err = tx.QueryRow(`SELECT r.hash FROM wikis w
+			JOIN revisions r ON r.id = w.revision WHERE w.name = ?`, name).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+
+		etag := ""
+		if current != "" {
+			etag = `"` + current + `"`
+		}
+
+		if !matchETag(ifMatch, etag) {
+			return "", ErrWikiChanged
+		}
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO contents (hash, data) VALUES (?, ?)`, hash, content)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := tx.Exec(`INSERT INTO revisions (wiki, hash, size, author, time) VALUES (?, ?, ?, ?, ?)`,
+		name, hash, len(content), author, time.Now().UTC().Format(c_sqliteTimeFormat))
+	if err != nil {
+		return "", err
+	}
+
+	revision, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO wikis (name, revision) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET revision = excluded.revision`, name, revision)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return contentETag(content), nil
+}
+
+// Delete removes the wiki but keeps its revisions, which still show up in
+// the history if a wiki with the same name is created again
+func (this *SQLiteStore) Delete(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	res, err := this.db.Exec(`DELETE FROM wikis WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sqliteError("delete", name, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// Rename moves the history of the wiki along with it, the history of a
+// deleted wiki with the new name is dropped
+func (this *SQLiteStore) Rename(oldname string, newname string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+
+	err = tx.QueryRow(`SELECT COUNT(*) FROM wikis WHERE name = ?`, newname).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists > 0 {
+		return ErrWikiExists
+	}
+
+	// A deleted wiki of the new name leaves its revisions behind, they would
+	// show up in the history of the renamed one
+	_, err = tx.Exec(`DELETE FROM revisions WHERE wiki = ?`, newname)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM contents WHERE hash NOT IN (SELECT hash FROM revisions)`)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE wikis SET name = ? WHERE name = ?`, newname, oldname)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sqliteError("rename", oldname, sql.ErrNoRows)
+	}
+
+	_, err = tx.Exec(`UPDATE revisions SET wiki = ? WHERE wiki = ?`, newname, oldname)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (this *SQLiteStore) Revisions(name string) ([]Revision, error) {
+	rows, err := this.db.Query(`SELECT id, size, time, author, hash FROM revisions
+		WHERE wiki = ? ORDER BY id DESC`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+
+	for rows.Next() {
+		var revision Revision
+		var id int64
+		var modTime string
+
+		err = rows.Scan(&id, &revision.Size, &modTime, &revision.Author, &revision.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		revision.Id = strconv.FormatInt(id, 10)
+		revision.Time = parseSQLiteTime(modTime)
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (this *SQLiteStore) OpenRevision(name string, id string) (io.ReadCloser, error) {
+	var content []byte
+
+	err := this.db.QueryRow(`SELECT c.data FROM revisions r
+		JOIN contents c ON c.hash = r.hash WHERE r.wiki = ? AND r.id = ?`, name, id).Scan(&content)
+	if err != nil {
+		return nil, sqliteError("open", name+"@"+id, err)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
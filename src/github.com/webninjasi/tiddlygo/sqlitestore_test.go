@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "wikis.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.db.Close()
+	})
+
+	return store
+}
+
+func readSQLiteWiki(t *testing.T, store *SQLiteStore, name string) string {
+	f, err := store.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// revisionContents returns the contents of the revisions of a wiki, newest first
+func revisionContents(t *testing.T, store *SQLiteStore, name string) []string {
+	revisions, err := store.Revisions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{}
+
+	for _, revision := range revisions {
+		f, err := store.OpenRevision(name, revision.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents = append(contents, string(content))
+	}
+
+	return contents
+}
+
+func TestSQLiteStoreSave(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	etag, err := store.SaveAs("notes.html", strings.NewReader("one"), "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if etag != contentETag([]byte("one")) {
+		t.Fatalf("etag = %v, want %v", etag, contentETag([]byte("one")))
+	}
+
+	_, err = store.SaveAs("notes.html", strings.NewReader("two"), `"stale"`, "bob")
+	if err != ErrWikiChanged {
+		t.Fatalf("save with a stale ETag: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	_, err = store.SaveAs("missing.html", strings.NewReader("two"), etag, "bob")
+	if err != ErrWikiChanged {
+		t.Fatalf("save of a missing wiki with an ETag: got %v, want %v", err, ErrWikiChanged)
+	}
+
+	etag, err = store.SaveAs("notes.html", strings.NewReader("two"), etag, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same content again is kept once but still is a revision
+	_, err = store.SaveAs("notes.html", strings.NewReader("one"), etag, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readSQLiteWiki(t, store, "notes.html"); content != "one" {
+		t.Fatalf("content = %q, want %q", content, "one")
+	}
+
+	info, err := store.Stat("notes.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 3 || info.ModTime.IsZero() {
+		t.Fatalf("stat = %+v", info)
+	}
+
+	revisions, err := store.Revisions("notes.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authors := []string{}
+	for _, revision := range revisions {
+		authors = append(authors, revision.Author)
+	}
+
+	if strings.Join(authors, ",") != "carol,bob,alice" {
+		t.Fatalf("authors = %v, want the newest first", authors)
+	}
+
+	if contents := revisionContents(t, store, "notes.html"); strings.Join(contents, ",") != "one,two,one" {
+		t.Fatalf("revisions = %v", contents)
+	}
+
+	if _, err := store.OpenRevision("other.html", revisions[0].Id); !os.IsNotExist(err) {
+		t.Fatalf("revision of another wiki: got %v, want a missing file", err)
+	}
+
+	if _, err := store.Stat("missing.html"); !os.IsNotExist(err) {
+		t.Fatalf("stat of a missing wiki: got %v, want a missing file", err)
+	}
+}
+
+func TestSQLiteStoreRename(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	for _, name := range []string{"one.html", "two.html", "old.html"} {
+		_, err := store.Save(name, strings.NewReader(name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Rename("one.html", "two.html"); err != ErrWikiExists {
+		t.Fatalf("rename onto another wiki: got %v, want %v", err, ErrWikiExists)
+	}
+
+	if err := store.Rename("missing.html", "three.html"); !os.IsNotExist(err) {
+		t.Fatalf("rename of a missing wiki: got %v, want a missing file", err)
+	}
+
+	// The deleted wiki keeps its history until another one takes its name
+	if err := store.Delete("old.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete("old.html"); !os.IsNotExist(err) {
+		t.Fatalf("delete of a missing wiki: got %v, want a missing file", err)
+	}
+
+	if contents := revisionContents(t, store, "old.html"); len(contents) != 1 {
+		t.Fatalf("revisions of the deleted wiki = %v", contents)
+	}
+
+	if err := store.Rename("one.html", "old.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	if content := readSQLiteWiki(t, store, "old.html"); content != "one.html" {
+		t.Fatalf("content = %q, want %q", content, "one.html")
+	}
+
+	if contents := revisionContents(t, store, "old.html"); strings.Join(contents, ",") != "one.html" {
+		t.Fatalf("revisions = %v, want only the renamed wiki's", contents)
+	}
+
+	if contents := revisionContents(t, store, "one.html"); len(contents) != 0 {
+		t.Fatalf("revisions under the old name = %v", contents)
+	}
+
+	wikis, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, wiki := range wikis {
+		names = append(names, wiki.Name)
+	}
+
+	if strings.Join(names, ",") != "old.html,two.html" {
+		t.Fatalf("wikis = %v, want [old.html two.html]", names)
+	}
+}
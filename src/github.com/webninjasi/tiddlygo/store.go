@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+var (
+	ErrWikiExists = errors.New("There is already a wiki with that name!")
+)
+
+// WikiInfo describes a stored wiki
+type WikiInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// WikiStore keeps the wikis, which are named like files, e.g. "notes.html".
+// Errors about a missing wiki satisfy os.IsNotExist.
+type WikiStore interface {
+	// List returns the wikis sorted by name
+	List() ([]WikiInfo, error)
+
+	Stat(name string) (WikiInfo, error)
+
+	// Open returns the html document of a wiki
+	Open(name string) (io.ReadCloser, error)
+
+	// Save creates or replaces a wiki at once, so it's never seen half written.
+	// If ifMatch isn't empty, the wiki is only replaced while its ETag matches,
+	// otherwise ErrWikiChanged is returned. It returns the new ETag.
+	Save(name string, r io.Reader, ifMatch string) (string, error)
+
+	Delete(name string) error
+
+	// Rename fails with ErrWikiExists if newname is taken
+	Rename(oldname string, newname string) error
+}
+
+// TiddlerStore is implemented by the stores which can change a tiddler
+// without rewriting the whole wiki
+type TiddlerStore interface {
+	PutTiddler(name string, tiddler *tiddlywiki.Tiddler) error
+
+	// DeleteTiddler reports whether the tiddler existed
+	DeleteTiddler(name string, title string) (bool, error)
+}
+
+// Revision is a saved version of a wiki
+type Revision struct {
+	Id     string
+	Size   int64
+	Time   time.Time
+	Author string
+	Hash   string
+}
+
+// HistoryStore is implemented by the stores which keep every saved revision
+// of the wikis along with who saved it
+type HistoryStore interface {
+	SaveAs(name string, r io.Reader, ifMatch string, author string) (string, error)
+
+	// Revisions returns the revisions of a wiki, newest first
+	Revisions(name string) ([]Revision, error)
+
+	OpenRevision(name string, id string) (io.ReadCloser, error)
+}
+
+// The store of the files is replaced when wikidir is changed in the config file
+var currentStore WikiStore = NewFileStore(cfg().WikiDir, cfg().Storage)
+var currentStoreLock sync.RWMutex
+
+// wikiStore returns the current storage of the wikis
+func wikiStore() WikiStore {
+	currentStoreLock.RLock()
+	defer currentStoreLock.RUnlock()
+
+	return currentStore
+}
+
+func setWikiStore(store WikiStore) {
+	currentStoreLock.Lock()
+	currentStore = store
+	currentStoreLock.Unlock()
+}
+
+// newWikiStore returns the store chosen by the storage option
+func newWikiStore(conf *Config) (WikiStore, error) {
+	switch conf.Storage {
+	case c_storageS3:
+		return NewS3Store(conf.S3)
+	case c_storageSQLite:
+		return NewSQLiteStore(conf.Database)
+	default:
+		return NewFileStore(conf.WikiDir, conf.Storage), nil
+	}
+}
+
+// readWiki returns the html document of a wiki
+func readWiki(wikiname string) ([]byte, error) {
+	f, err := wikiStore().Open(wikiname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// saveWikiAs saves a wiki and records its author if the store keeps a history
+func saveWikiAs(store WikiStore, name string, r io.Reader, ifMatch string, author string) (string, error) {
+	if hs, ok := store.(HistoryStore); ok {
+		return hs.SaveAs(name, r, ifMatch, author)
+	}
+
+	return store.Save(name, r, ifMatch)
+}
+
+// isWiki reports whether a wiki exists
+func isWiki(wikiname string) bool {
+	_, err := wikiStore().Stat(wikiname)
+	return err == nil
+}
+
+// contentETag returns a strong ETag made from the content hash of a wiki
+func contentETag(content []byte) string {
+	hash := sha1.New()
+	hash.Write(content)
+
+	return hashETag(hash)
+}
+
+// tiddlerStore returns a way to change single tiddlers of a wiki, which
+// rewrites the whole wiki if the store has no better way
+func tiddlerStore(store WikiStore, author string) TiddlerStore {
+	if ts, ok := store.(TiddlerStore); ok {
+		return ts
+	}
+
+	return wholeWikiStore{store, author}
+}
+
+// wholeWikiStore changes a tiddler by saving the whole wiki with the change
+type wholeWikiStore struct {
+	store  WikiStore
+	author string
+}
+
+func (this wholeWikiStore) PutTiddler(name string, tiddler *tiddlywiki.Tiddler) error {
+	return this.change(name, func(wiki *tiddlywiki.Wiki) bool {
+		wiki.Put(tiddler)
+		return true
+	})
+}
+
+func (this wholeWikiStore) DeleteTiddler(name string, title string) (bool, error) {
+	found := false
+
+	err := this.change(name, func(wiki *tiddlywiki.Wiki) bool {
+		found = wiki.Delete(title)
+		return found
+	})
+
+	return found, err
+}
+
+// change applies a change to the wiki and saves it unless it was changed
+// by someone else in the meantime
+func (this wholeWikiStore) change(name string, apply func(wiki *tiddlywiki.Wiki) bool) error {
+	f, err := this.store.Open(name)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return err
+	}
+
+	if !apply(wiki) {
+		return nil
+	}
+
+	changed, err := wiki.Bytes()
+	if err != nil {
+		return err
+	}
+
+	_, err = saveWikiAs(this.store, name, bytes.NewReader(changed), contentETag(content), this.author)
+
+	return err
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+const c_testTemplate = "../../../../templates/tiddlywiki-5.1.11.html"
+
+// memStore keeps the wikis in memory and changes single tiddlers like the
+// stores which have a TiddlerStore. Every change moves the modification
+// time on, so the cached wikis are read again.
+type memStore struct {
+	lock    sync.Mutex
+	wikis   map[string][]byte
+	times   map[string]time.Time
+	changes int
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		wikis: map[string][]byte{},
+		times: map[string]time.Time{},
+	}
+}
+
+func (this *memStore) List() ([]WikiInfo, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	wikis := []WikiInfo{}
+
+	for name, content := range this.wikis {
+		wikis = append(wikis, WikiInfo{name, int64(len(content)), this.times[name]})
+	}
+
+	sort.Slice(wikis, func(i, j int) bool {
+		return wikis[i].Name < wikis[j].Name
+	})
+
+	return wikis, nil
+}
+
+func (this *memStore) Stat(name string) (WikiInfo, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	content, ok := this.wikis[name]
+	if !ok {
+		return WikiInfo{}, os.ErrNotExist
+	}
+
+	return WikiInfo{name, int64(len(content)), this.times[name]}, nil
+}
+
+func (this *memStore) Open(name string) (io.ReadCloser, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	content, ok := this.wikis[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (this *memStore) Save(name string, r io.Reader, ifMatch string) (string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if old, ok := this.wikis[name]; ifMatch != "" && (!ok || !matchETag(ifMatch, contentETag(old))) {
+		return "", ErrWikiChanged
+	}
+
+	this.set(name, content)
+
+	return contentETag(content), nil
+}
+
+// set stores a wiki, the caller must hold the lock
+func (this *memStore) set(name string, content []byte) {
+	this.changes++
+	this.wikis[name] = content
+	this.times[name] = time.Date(2024, 1, 1, 0, 0, this.changes, 0, time.UTC)
+}
+
+func (this *memStore) Delete(name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.wikis[name]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(this.wikis, name)
+	delete(this.times, name)
+
+	return nil
+}
+
+func (this *memStore) Rename(oldname string, newname string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.wikis[newname]; ok {
+		return ErrWikiExists
+	}
+
+	content, ok := this.wikis[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	delete(this.wikis, oldname)
+	delete(this.times, oldname)
+	this.set(newname, content)
+
+	return nil
+}
+
+func (this *memStore) PutTiddler(name string, tiddler *tiddlywiki.Tiddler) error {
+	return this.change(name, func(wiki *tiddlywiki.Wiki) bool {
+		wiki.Put(tiddler)
+		return true
+	})
+}
+
+func (this *memStore) DeleteTiddler(name string, title string) (bool, error) {
+	found := false
+
+	err := this.change(name, func(wiki *tiddlywiki.Wiki) bool {
+		found = wiki.Delete(title)
+		return found
+	})
+
+	return found, err
+}
+
+func (this *memStore) change(name string, apply func(wiki *tiddlywiki.Wiki) bool) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	content, ok := this.wikis[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return err
+	}
+
+	if !apply(wiki) {
+		return nil
+	}
+
+	changed, err := wiki.Bytes()
+	if err != nil {
+		return err
+	}
+
+	this.set(name, changed)
+
+	return nil
+}
+
+func readTestTemplate(t *testing.T) []byte {
+	content, err := ioutil.ReadFile(c_testTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// A tiddler stored through the file storage only becomes a tiddler
+// directory with the "tiddlers" storage
+func TestFileStoreTiddlerLayout(t *testing.T) {
+	tests := []struct {
+		storage string
+		file    bool
+	}{
+		{c_storageFile, true},
+		{c_storageTiddlers, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.storage, func(t *testing.T) {
+			store := NewFileStore(t.TempDir(), c_storageFile)
+
+			_, err := store.Save("notes.html", bytes.NewReader(readTestTemplate(t)), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store.Storage = test.storage
+
+			tiddler := tiddlywiki.NewTiddler("New Tiddler")
+			tiddler.Text = "stored"
+
+			err = store.PutTiddler("notes.html", tiddler)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, file := store.Path("notes.html"); file != test.file {
+				t.Fatalf("single file = %v after a put, want %v", file, test.file)
+			}
+
+			found, err := store.DeleteTiddler("notes.html", "$:/SiteTitle")
+			if err != nil || !found {
+				t.Fatalf("delete: found = %v, err = %v", found, err)
+			}
+
+			if _, file := store.Path("notes.html"); file != test.file {
+				t.Fatalf("single file = %v after a delete, want %v", file, test.file)
+			}
+
+			f, err := store.Open("notes.html")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wiki, err := tiddlywiki.Parse(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := wiki.Tiddler("New Tiddler"); got == nil || got.Text != "stored" {
+				t.Fatal("the stored tiddler is missing")
+			}
+
+			if wiki.Tiddler("$:/SiteTitle") != nil {
+				t.Fatal("the deleted tiddler is still there")
+			}
+
+			if test.file {
+				entries, _ := ioutil.ReadDir(store.Dir)
+				for _, entry := range entries {
+					if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".html") {
+						t.Fatalf("unexpected %v in the wiki directory", filepath.Join(store.Dir, entry.Name()))
+					}
+				}
+			}
+		})
+	}
+}
+
+// Only one of the creates of a wiki wins, the others don't replace it
+func TestCreateWiki(t *testing.T) {
+	store, _ := useTestServer(t)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = createWiki("new.html", []byte{byte('0' + i)}, "alice")
+		}(i)
+	}
+
+	wg.Wait()
+
+	created := -1
+	for i, err := range errs {
+		if err == nil && created == -1 {
+			created = i
+		} else if err != ErrWikiExists {
+			t.Fatalf("create %v: got %v, want %v", i, err, ErrWikiExists)
+		}
+	}
+
+	if created == -1 {
+		t.Fatal("the wiki wasn't created")
+	}
+
+	if content := string(store.wikis["new.html"]); content != string([]byte{byte('0' + created)}) {
+		t.Fatalf("content = %q, want the one of the create which won", content)
+	}
+
+	// A new wiki isn't created over an existing one
+	cfg().TemplateDir = filepath.Dir(c_testTemplate)
+
+	old := string(store.wikis["notes.html"])
+
+	for _, name := range []string{"notes", "other"} {
+		form := url.Values{"wikiname": {name}, "wikitemplate": {filepath.Base(c_testTemplate)}}
+
+		req := httptest.NewRequest("POST", "/new", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("tiddlygo", "tiddlygo")
+
+		rec := httptest.NewRecorder()
+		getRouter().ServeHTTP(rec, req)
+
+		if name == "notes" && rec.Code != http.StatusBadRequest {
+			t.Fatalf("create over an existing wiki: status = %v", rec.Code)
+		}
+
+		if name == "other" && rec.Code != http.StatusOK {
+			t.Fatalf("create: status = %v: %v", rec.Code, rec.Body.String())
+		}
+	}
+
+	if string(store.wikis["notes.html"]) != old {
+		t.Fatal("the existing wiki was replaced")
+	}
+
+	if _, ok := store.wikis["other.html"]; !ok {
+		t.Fatal("the new wiki is missing")
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+const c_shellFile = "shell.html"
+const c_tiddlersDir = "tiddlers"
+const c_maxFileNameLength = 200
+
+var reUnsafeFileChars = regexp.MustCompile(`[<>:"/\\|?*^\x00-\x1f]`)
+
+// tiddlerFile is a parsed tiddler file, kept until the file
+// or its .meta file changes
+type tiddlerFile struct {
+	modTime     time.Time
+	size        int64
+	metaModTime time.Time
+	metaSize    int64
+	tiddler     *tiddlywiki.Tiddler
+}
+
+// tiddlerData is the content of a tiddler file and of its .meta file, if any
+type tiddlerData struct {
+	ext  string
+	data []byte
+	meta []byte
+}
+
+type tiddlerFileType struct {
+	ext    string
+	binary bool
+}
+
+// tiddlerFileTypes are the types which are stored in their own format with
+// the fields in a .meta file next to them, the same way TiddlyWiki5 does.
+// The text of binary tiddlers is base64 encoded.
+var tiddlerFileTypes = map[string]tiddlerFileType{
+	"application/javascript": {".js", false},
+	"application/json":       {".json", false},
+	"application/pdf":        {".pdf", true},
+	"audio/mpeg":             {".mp3", true},
+	"audio/ogg":              {".ogg", true},
+	"font/woff":              {".woff", true},
+	"font/woff2":             {".woff2", true},
+	"image/gif":              {".gif", true},
+	"image/jpeg":             {".jpg", true},
+	"image/png":              {".png", true},
+	"image/svg+xml":          {".svg", false},
+	"image/webp":             {".webp", true},
+	"image/x-icon":           {".ico", true},
+	"text/css":               {".css", false},
+	"text/html":              {".html", false},
+	"text/markdown":          {".md", false},
+	"text/plain":             {".txt", false},
+	"video/mp4":              {".mp4", true},
+}
+
+// tiddlerFileExts gives the type of the files whose .meta file has no type
+var tiddlerFileExts = map[string]string{
+	".css":   "text/css",
+	".gif":   "image/gif",
+	".htm":   "text/html",
+	".html":  "text/html",
+	".ico":   "image/x-icon",
+	".jpeg":  "image/jpeg",
+	".jpg":   "image/jpeg",
+	".js":    "application/javascript",
+	".json":  "application/json",
+	".md":    "text/markdown",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".ogg":   "audio/ogg",
+	".pdf":   "application/pdf",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".txt":   "text/plain",
+	".webp":  "image/webp",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// TiddlerDir is a wiki stored as a directory instead of a single html file:
+// the wiki with an empty store area in shell.html and a file for each
+// tiddler in tiddlers/. Wikitext tiddlers are .tid files, the other types
+// are kept in their own format with a .meta file like "image.png.meta",
+// and the tiddlers which fit neither are .json files.
+type TiddlerDir struct {
+	sync.Mutex
+
+	Path  string
+	files map[string]tiddlerFile
+}
+
+var tiddlerDirs = struct {
+	sync.Mutex
+	dirs map[string]*TiddlerDir
+}{dirs: map[string]*TiddlerDir{}}
+
+// isTiddlerDir reports whether a directory holds a wiki as tiddlers
+func isTiddlerDir(path string) bool {
+	return isExist(filepath.Join(path, c_shellFile))
+}
+
+// getTiddlerDir returns the tiddler directory at path, even if it's empty
+func getTiddlerDir(path string) *TiddlerDir {
+	tiddlerDirs.Lock()
+	defer tiddlerDirs.Unlock()
+
+	dir, ok := tiddlerDirs.dirs[path]
+	if !ok {
+		dir = &TiddlerDir{
+			Path:  path,
+			files: map[string]tiddlerFile{},
+		}
+
+		tiddlerDirs.dirs[path] = dir
+	}
+
+	return dir
+}
+
+// forgetTiddlerDir drops the cache of a tiddler directory which is moved away
+func forgetTiddlerDir(path string) {
+	tiddlerDirs.Lock()
+	delete(tiddlerDirs.dirs, path)
+	tiddlerDirs.Unlock()
+}
+
+// refresh reads the tiddler files which have changed since the last time
+func (this *TiddlerDir) refresh() error {
+	dir := filepath.Join(this.Path, c_tiddlersDir)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	byName := map[string]os.FileInfo{}
+	for _, info := range infos {
+		byName[info.Name()] = info
+	}
+
+	seen := map[string]bool{}
+
+	for _, info := range infos {
+		name := info.Name()
+		ext := filepath.Ext(name)
+
+		if info.IsDir() || strings.HasPrefix(name, ".") || ext == ".meta" {
+			continue
+		}
+
+		metaInfo, hasMeta := byName[name+".meta"]
+		if !hasMeta && ext != ".tid" && ext != ".json" {
+			continue
+		}
+
+		seen[name] = true
+
+		file := tiddlerFile{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+
+		if hasMeta {
+			file.metaModTime = metaInfo.ModTime()
+			file.metaSize = metaInfo.Size()
+		}
+
+		cached, ok := this.files[name]
+		if ok && cached.modTime.Equal(file.modTime) && cached.size == file.size &&
+			cached.metaModTime.Equal(file.metaModTime) && cached.metaSize == file.metaSize {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+
+		tiddler, err := readTiddlerFile(path, hasMeta)
+		if os.IsNotExist(err) {
+			delete(this.files, name)
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: Couldn't read the tiddler file '%v': %v\n", path, err)
+			delete(this.files, name)
+			continue
+		}
+
+		file.tiddler = tiddler
+		this.files[name] = file
+	}
+
+	for name := range this.files {
+		if !seen[name] {
+			delete(this.files, name)
+		}
+	}
+
+	return nil
+}
+
+// titles returns the file name of each tiddler by title
+func (this *TiddlerDir) titles() map[string]string {
+	names := make([]string, 0, len(this.files))
+	for name := range this.files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	titles := map[string]string{}
+
+	for _, name := range names {
+		title := this.files[name].tiddler.Title
+
+		if _, ok := titles[title]; !ok {
+			titles[title] = name
+		}
+	}
+
+	return titles
+}
+
+// Tiddlers returns the tiddlers sorted by title.
+// They are shared with the cache and must not be modified.
+func (this *TiddlerDir) Tiddlers() ([]*tiddlywiki.Tiddler, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	err := this.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := []*tiddlywiki.Tiddler{}
+
+	for _, name := range this.titles() {
+		tiddlers = append(tiddlers, this.files[name].tiddler)
+	}
+
+	sort.Slice(tiddlers, func(i, j int) bool {
+		return tiddlers[i].Title < tiddlers[j].Title
+	})
+
+	return tiddlers, nil
+}
+
+// Tiddler returns the tiddler with the given title or nil
+func (this *TiddlerDir) Tiddler(title string) (*tiddlywiki.Tiddler, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	err := this.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := this.titles()[title]
+	if !ok {
+		return nil, nil
+	}
+
+	return this.files[name].tiddler, nil
+}
+
+// Put writes a tiddler into its file, replacing the one with the same title
+func (this *TiddlerDir) Put(tiddler *tiddlywiki.Tiddler) error {
+	this.Lock()
+	defer this.Unlock()
+
+	err := this.refresh()
+	if err != nil {
+		return err
+	}
+
+	_, err = this.put(tiddler, this.titles())
+
+	return err
+}
+
+// put writes a tiddler unless its files already have the same content
+// and returns the name of the file
+func (this *TiddlerDir) put(tiddler *tiddlywiki.Tiddler, titles map[string]string) (string, error) {
+	enc, err := encodeTiddler(tiddler)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(this.Path, c_tiddlersDir)
+	name, exists := titles[tiddler.Title]
+
+	if exists && filepath.Ext(name) == enc.ext {
+		old, err := encodeTiddler(this.files[name].tiddler)
+		if err == nil && bytes.Equal(old.data, enc.data) && bytes.Equal(old.meta, enc.meta) {
+			return name, nil
+		}
+	} else {
+		name = this.freeFileName(tiddler.Title, enc.ext)
+	}
+
+	path := filepath.Join(dir, name)
+
+	err = writeFileAtomic(path, enc.data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	if enc.meta != nil {
+		err = writeFileAtomic(path+".meta", enc.meta, 0644)
+	} else {
+		err = os.Remove(path + ".meta")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if oldName, ok := titles[tiddler.Title]; ok && oldName != name {
+		err = this.remove(oldName)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	file := tiddlerFile{tiddler: tiddler.Clone()}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	file.modTime, file.size = info.ModTime(), info.Size()
+
+	if enc.meta != nil {
+		info, err = os.Stat(path + ".meta")
+		if err != nil {
+			return "", err
+		}
+
+		file.metaModTime, file.metaSize = info.ModTime(), info.Size()
+	}
+
+	this.files[name] = file
+	titles[tiddler.Title] = name
+
+	return name, nil
+}
+
+// remove deletes a tiddler file along with its .meta file
+func (this *TiddlerDir) remove(name string) error {
+	path := filepath.Join(this.Path, c_tiddlersDir, name)
+
+	for _, p := range []string{path, path + ".meta"} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	delete(this.files, name)
+
+	return nil
+}
+
+// Delete removes the file of a tiddler and reports whether it existed
+func (this *TiddlerDir) Delete(title string) (bool, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	err := this.refresh()
+	if err != nil {
+		return false, err
+	}
+
+	name, ok := this.titles()[title]
+	if !ok {
+		return false, nil
+	}
+
+	err = this.remove(name)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// freeFileName returns a file name for a tiddler which isn't used by another
+// tiddler, also on case-insensitive file systems
+func (this *TiddlerDir) freeFileName(title string, ext string) string {
+	used := map[string]bool{}
+	for name, file := range this.files {
+		if file.tiddler.Title != title {
+			used[strings.ToLower(name)] = true
+		}
+	}
+
+	// "image.png" shouldn't become "image.png.png"
+	base := tiddlerFileName(title)
+	if trimmed := strings.TrimSuffix(base, ext); trimmed != "" {
+		base = trimmed
+	}
+
+	name := base + ext
+
+	for i := 1; used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%v %v%v", base, i, ext)
+	}
+
+	return name
+}
+
+// Store replaces the tiddlers with the ones of a whole wiki. Only the files
+// of the tiddlers which have changed are written.
+func (this *TiddlerDir) Store(content []byte) error {
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return ErrInvalidWiki
+	}
+
+	tiddlers := wiki.Tiddlers()
+
+	for _, tiddler := range tiddlers {
+		wiki.Delete(tiddler.Title)
+	}
+
+	shell, err := wiki.Bytes()
+	if err != nil {
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	err = os.MkdirAll(filepath.Join(this.Path, c_tiddlersDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = this.refresh()
+	if err != nil {
+		return err
+	}
+
+	titles := this.titles()
+	keep := map[string]bool{}
+
+	for _, tiddler := range tiddlers {
+		name, err := this.put(tiddler, titles)
+		if err != nil {
+			return err
+		}
+
+		keep[name] = true
+	}
+
+	for name := range this.files {
+		if keep[name] {
+			continue
+		}
+
+		err = this.remove(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	shellpath := filepath.Join(this.Path, c_shellFile)
+
+	old, err := ioutil.ReadFile(shellpath)
+	if err == nil && bytes.Equal(old, shell) {
+		return nil
+	}
+
+	return writeFileAtomic(shellpath, shell, fileMode(shellpath, 0644))
+}
+
+// Wiki assembles the shell and the tiddlers into a whole wiki
+func (this *TiddlerDir) Wiki() (*tiddlywiki.Wiki, error) {
+	shell, err := ioutil.ReadFile(filepath.Join(this.Path, c_shellFile))
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers, err := this.Tiddlers()
+	if err != nil {
+		return nil, err
+	}
+
+	return assembleWiki(shell, tiddlers)
+}
+
+func assembleWiki(shell []byte, tiddlers []*tiddlywiki.Tiddler) (*tiddlywiki.Wiki, error) {
+	wiki, err := tiddlywiki.Parse(shell)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tiddler := range tiddlers {
+		wiki.Put(tiddler)
+	}
+
+	return wiki, nil
+}
+
+// encodeTiddler returns the content of the files of a tiddler
+func encodeTiddler(tiddler *tiddlywiki.Tiddler) (tiddlerData, error) {
+	fileType, ok := tiddlerFileTypes[tiddler.Field("type")]
+
+	// Tiddlers pointing at an external file only have their fields
+	if ok && tiddler.Field("_canonical_uri") == "" {
+		if meta, ok := tiddler.MetaFields(); ok {
+			data := []byte(tiddler.Text)
+
+			if !fileType.binary {
+				return tiddlerData{fileType.ext, data, meta}, nil
+			}
+
+			data, err := base64.StdEncoding.DecodeString(tiddler.Text)
+			if err == nil && base64.StdEncoding.EncodeToString(data) == tiddler.Text {
+				return tiddlerData{fileType.ext, data, meta}, nil
+			}
+		}
+	}
+
+	if data, ok := tiddler.Tid(); ok {
+		return tiddlerData{".tid", data, nil}, nil
+	}
+
+	data, err := tiddlywiki.JSON([]*tiddlywiki.Tiddler{tiddler})
+
+	return tiddlerData{".json", data, nil}, err
+}
+
+// readTiddlerFile reads a tiddler file and its .meta file if it has one
+func readTiddlerFile(path string, hasMeta bool) (*tiddlywiki.Tiddler, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta []byte
+
+	if hasMeta {
+		meta, err = ioutil.ReadFile(path + ".meta")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseTiddlerFile(filepath.Base(path), data, meta)
+}
+
+// parseTiddlerFile parses a tiddler file, meta is nil if it has no .meta file
+func parseTiddlerFile(name string, data []byte, meta []byte) (*tiddlywiki.Tiddler, error) {
+	ext := filepath.Ext(name)
+
+	if meta != nil {
+		fields := tiddlywiki.ParseFields(meta)
+
+		if fields["title"] == "" {
+			fields["title"] = strings.TrimSuffix(name, ext)
+		}
+
+		if fields["type"] == "" {
+			fields["type"] = tiddlerFileExts[ext]
+		}
+
+		if tiddlerFileTypes[fields["type"]].binary {
+			fields["text"] = base64.StdEncoding.EncodeToString(data)
+		} else {
+			fields["text"] = string(data)
+		}
+
+		return tiddlywiki.NewTiddlerFromFields(fields), nil
+	}
+
+	if ext == ".tid" {
+		return tiddlywiki.ParseTid(data)
+	}
+
+	tiddlers, err := tiddlywiki.ParseJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tiddlers) != 1 {
+		return nil, fmt.Errorf("expected a tiddler, found %v", len(tiddlers))
+	}
+
+	return tiddlers[0], nil
+}
+
+// tiddlerFileName makes a file name out of a title the way TiddlyWiki5 does,
+// e.g. "$:/config/Name" becomes "$__config_Name"
+func tiddlerFileName(title string) string {
+	name := reUnsafeFileChars.ReplaceAllString(title, "_")
+	name = strings.TrimRight(name, ". ")
+
+	if len(name) > c_maxFileNameLength {
+		name = name[:c_maxFileNameLength]
+
+		// Don't cut a character in half
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+
+	if name == "" || strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// writeFileAtomic replaces a file through a temp file,
+// so it's never left half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	_, err = out.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = out.Chmod(perm)
+	if err != nil {
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/webninjasi/tiddlygo/tiddlywiki"
+)
+
+// TiddlyWeb has recipes made of bags, every wiki here has a single one of each
+const c_tiddlyWebRecipe = "default"
+const c_tiddlyWebBag = "default"
+const c_tiddlyWebPlugin = "$:/plugins/tiddlywiki/tiddlyweb"
+const c_tiddlyWebHost = "$:/config/tiddlyweb/host"
+const c_defaultTiddlerType = "text/vnd.tiddlywiki"
+
+// tiddlyWebFields are the fields TiddlyWeb keeps outside of "fields"
+var tiddlyWebFields = map[string]bool{
+	"bag":         true,
+	"created":     true,
+	"creator":     true,
+	"modified":    true,
+	"modifier":    true,
+	"permissions": true,
+	"recipe":      true,
+	"revision":    true,
+	"tags":        true,
+	"text":        true,
+	"title":       true,
+	"type":        true,
+	"uri":         true,
+}
+
+type TiddlyWebStatus struct {
+	Username  string         `json:"username"`
+	Anonymous bool           `json:"anonymous"`
+	ReadOnly  bool           `json:"read_only"`
+	Space     TiddlyWebSpace `json:"space"`
+}
+
+type TiddlyWebSpace struct {
+	Recipe string `json:"recipe"`
+}
+
+// tiddlyWebStatus tells TiddlyWiki5's tiddlyweb plugin who is logged in
+func tiddlyWebStatus(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	if !isWiki(wikiname) {
+		http.Error(w, "Couldn't find the wiki!", http.StatusNotFound)
+		return
+	}
+
+	status := TiddlyWebStatus{
+		Username:  "GUEST",
+		Anonymous: true,
+		Space:     TiddlyWebSpace{c_tiddlyWebRecipe},
+	}
+
+	login, ok := requestUser(r)
+	if ok {
+		status.Username = login.User
+		status.Anonymous = false
+	}
+
+	// The plugin doesn't try to save if it can't
+	status.ReadOnly = login.Role(wikiname) < RoleWrite
+
+	writeJSON(w, status)
+}
+
+// listTiddlyWebTiddlers returns the skinny tiddlers, all fields but the text
+func listTiddlyWebTiddlers(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	tiddlers, ok := tiddlyWebTiddlers(w, wikiname)
+	if !ok {
+		return
+	}
+
+	data := []map[string]interface{}{}
+
+	for _, tiddler := range tiddlers {
+		// Plugins are too big to sync, they are loaded with the wiki
+		if tiddler.Field("plugin-type") != "" {
+			continue
+		}
+
+		data = append(data, tiddlyWebTiddler(tiddler, false))
+	}
+
+	writeJSON(w, data)
+}
+
+func getTiddlyWebTiddler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	title, err := url.PathUnescape(params["title"])
+	if err != nil {
+		http.Error(w, "Invalid title!", http.StatusBadRequest)
+		return
+	}
+
+	tiddlers, ok := tiddlyWebTiddlers(w, wikiname)
+	if !ok {
+		return
+	}
+
+	for _, tiddler := range tiddlers {
+		if tiddler.Title == title {
+			w.Header().Set("ETag", tiddlyWebETag(tiddler))
+			writeJSON(w, tiddlyWebTiddler(tiddler, true))
+			return
+		}
+	}
+
+	http.Error(w, "Couldn't find the tiddler!", http.StatusNotFound)
+}
+
+func putTiddlyWebTiddler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	title, err := url.PathUnescape(params["title"])
+	if err != nil || title == "" {
+		http.Error(w, "Invalid title!", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := authorize(w, r, wikiname, RoleWrite)
+	if !ok {
+		return
+	}
+
+	raw := map[string]interface{}{}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, c_maxFileSize)).Decode(&raw)
+	if err != nil {
+		http.Error(w, "Invalid tiddler!", http.StatusBadRequest)
+		return
+	}
+
+	tiddler := parseTiddlyWebTiddler(title, raw)
+
+	err = storeTiddler(wikiname, user, tiddler.Field("draft.of") != "", func(ts TiddlerStore) error {
+		return ts.PutTiddler(wikiname, tiddler)
+	})
+	if os.IsNotExist(err) {
+		http.Error(w, "Couldn't find the wiki!", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Couldn't store the tiddler!", http.StatusInternalServerError)
+		log.Printf("Error while storing '%v' in '%v': %v\n", title, wikiname, err)
+		return
+	}
+
+	w.Header().Set("ETag", tiddlyWebETag(tiddler))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteTiddlyWebTiddler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := params["wikiname"]
+
+	title, err := url.PathUnescape(params["title"])
+	if err != nil {
+		http.Error(w, "Invalid title!", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := authorize(w, r, wikiname, RoleWrite)
+	if !ok {
+		return
+	}
+
+	tiddlers, ok := tiddlyWebTiddlers(w, wikiname)
+	if !ok {
+		return
+	}
+
+	var tiddler *tiddlywiki.Tiddler
+
+	for _, t := range tiddlers {
+		if t.Title == title {
+			tiddler = t
+			break
+		}
+	}
+
+	if tiddler == nil {
+		http.Error(w, "Couldn't find the tiddler!", http.StatusNotFound)
+		return
+	}
+
+	err = storeTiddler(wikiname, user, tiddler.Field("draft.of") != "", func(ts TiddlerStore) error {
+		_, err := ts.DeleteTiddler(wikiname, title)
+		return err
+	})
+	if os.IsNotExist(err) {
+		http.Error(w, "Couldn't find the wiki!", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Couldn't delete the tiddler!", http.StatusInternalServerError)
+		log.Printf("Error while deleting '%v' from '%v': %v\n", title, wikiname, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeTiddler changes the tiddlers of a wiki through the wiki store.
+// The store events are fired unless the change is only about a draft,
+// which is saved while typing.
+func storeTiddler(wikiname string, user string, draft bool, change func(ts TiddlerStore) error) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if !isWiki(wikiname) {
+		return os.ErrNotExist
+	}
+
+	if !draft {
+		evtHandler.Handle("prestore", wikiname, user)
+	}
+
+	err := change(tiddlerStore(wikiStore(), user))
+	if err != nil {
+		return err
+	}
+
+	if !draft {
+		evtHandler.Handle("poststore", wikiname, user)
+	}
+
+	return nil
+}
+
+// tiddlyWebTiddlers returns the tiddlers of a wiki sorted by title
+// and writes an error response if it fails
+func tiddlyWebTiddlers(w http.ResponseWriter, wikiname string) ([]*tiddlywiki.Tiddler, bool) {
+	wiki, ok := apiWiki(w, wikiname)
+	if !ok {
+		return nil, false
+	}
+
+	tiddlers := wiki.Tiddlers()
+
+	sort.Slice(tiddlers, func(i, j int) bool {
+		return tiddlers[i].Title < tiddlers[j].Title
+	})
+
+	return tiddlers, true
+}
+
+// tiddlyWebTiddler converts a tiddler into the JSON format of TiddlyWeb
+func tiddlyWebTiddler(tiddler *tiddlywiki.Tiddler, withText bool) map[string]interface{} {
+	data := map[string]interface{}{}
+	fields := map[string]string{}
+
+	for name, value := range tiddler.Map() {
+		switch {
+		case name == "text" && !withText:
+		case name == "tags":
+		case tiddlyWebFields[name]:
+			data[name] = value
+		default:
+			fields[name] = value
+		}
+	}
+
+	data["tags"] = tiddler.Tags
+	data["fields"] = fields
+	data["bag"] = c_tiddlyWebBag
+	data["revision"] = tiddlerRevision(tiddler)
+
+	if _, ok := data["type"]; !ok {
+		data["type"] = c_defaultTiddlerType
+	}
+
+	return data
+}
+
+// parseTiddlyWebTiddler converts a tiddler in the JSON format of TiddlyWeb.
+// The fields which only make sense on the server are dropped.
+func parseTiddlyWebTiddler(title string, raw map[string]interface{}) *tiddlywiki.Tiddler {
+	fields := map[string]string{}
+
+	for name, value := range raw {
+		switch name {
+		case "bag", "recipe", "revision", "permissions", "uri":
+		case "fields":
+			custom, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			for name, value := range custom {
+				fields[name] = tiddlywiki.FieldString(value)
+			}
+		default:
+			fields[name] = tiddlywiki.FieldString(value)
+		}
+	}
+
+	fields["title"] = title
+
+	return tiddlywiki.NewTiddlerFromFields(fields)
+}
+
+// tiddlerRevision is made from the content of the tiddler,
+// so it stays the same across restarts and changes with any field
+func tiddlerRevision(tiddler *tiddlywiki.Tiddler) string {
+	data, _ := json.Marshal(tiddler.Map())
+	sum := sha1.Sum(data)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// tiddlyWebETag is parsed by the tiddlyweb plugin to get the revision
+func tiddlyWebETag(tiddler *tiddlywiki.Tiddler) string {
+	return `"` + c_tiddlyWebBag + "/" + url.PathEscape(tiddler.Title) + "/" + tiddlerRevision(tiddler) + `:"`
+}
+
+// tiddlyWebHost points the tiddlyweb plugin at the endpoints of the wiki
+func tiddlyWebHost(wikiname string) *tiddlywiki.Tiddler {
+	host := tiddlywiki.NewTiddler(c_tiddlyWebHost)
+	host.Text = "$protocol$//$host$/wikis/" + wikiname + "/"
+
+	return host
+}
+
+// hasTiddlyWeb reports whether a wiki file has the tiddlyweb plugin
+func hasTiddlyWeb(wikiname string) bool {
+	wiki, err := loadWiki(wikiname)
+
+	return err == nil && wiki.Tiddler(c_tiddlyWebPlugin) != nil
+}
+
+// injectTiddlyWebHost points the tiddlyweb plugin of a wiki at its endpoints
+func injectTiddlyWebHost(wikiname string, content []byte) ([]byte, error) {
+	wiki, err := tiddlywiki.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	wiki.Put(tiddlyWebHost(wikiname))
+
+	return wiki.Bytes()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// eventRecorder is an event action which remembers the events it ran for
+type eventRecorder struct {
+	lock   sync.Mutex
+	name   string
+	events *[]string
+}
+
+func (this *eventRecorder) Do(args ...string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	*this.events = append(*this.events, this.name)
+
+	return nil
+}
+
+func (this *eventRecorder) CombineArgs(args []string) []string {
+	return args
+}
+
+// useTestServer serves a wiki of the bundled template from memory, the
+// config's user is "tiddlygo" and the fired events are recorded
+func useTestServer(t *testing.T) (*memStore, *[]string) {
+	dir := t.TempDir()
+
+	conf := NewConfig()
+	conf.WikiDir = dir
+	conf.UserFile = filepath.Join(dir, "users.json")
+	conf.ACLFile = filepath.Join(dir, "acl.json")
+	conf.TokenFile = filepath.Join(dir, "tokens.json")
+
+	store := newMemStore()
+	store.wikis["notes.html"] = readTestTemplate(t)
+
+	events := &[]string{}
+
+	oldConf, oldStore := cfg(), wikiStore()
+
+	evtHandler.lock.Lock()
+	oldActions := evtHandler.actions
+	evtHandler.actions = EventActionMap{
+		"prestore":  {&eventRecorder{name: "prestore", events: events}},
+		"poststore": {&eventRecorder{name: "poststore", events: events}},
+	}
+	evtHandler.lock.Unlock()
+
+	setConfig(conf)
+	setWikiStore(store)
+
+	t.Cleanup(func() {
+		setConfig(oldConf)
+		setWikiStore(oldStore)
+
+		evtHandler.lock.Lock()
+		evtHandler.actions = oldActions
+		evtHandler.lock.Unlock()
+	})
+
+	return store, events
+}
+
+func tiddlerURL(title string) string {
+	return "/wikis/notes.html/recipes/default/tiddlers/" + url.PathEscape(title)
+}
+
+func TestTiddlyWebTiddlers(t *testing.T) {
+	_, events := useTestServer(t)
+	router := getRouter()
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		auth    bool
+		status  int
+		events  []string
+		text    string
+		missing bool
+	}{
+		{
+			name:   "get a system tiddler",
+			method: "GET",
+			url:    tiddlerURL("$:/isEncrypted"),
+			status: http.StatusOK,
+			text:   "no",
+		},
+		{
+			name:   "get a missing tiddler",
+			method: "GET",
+			url:    tiddlerURL("Missing"),
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "put without a login",
+			method: "PUT",
+			url:    tiddlerURL("A: B"),
+			body:   `{"text":"one"}`,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "put a tiddler",
+			method: "PUT",
+			url:    tiddlerURL("A: B"),
+			body:   `{"text":"one </script>","tags":"[[two words]]","fields":{"caption":"first\nsecond"}}`,
+			auth:   true,
+			status: http.StatusNoContent,
+			events: []string{"prestore", "poststore"},
+			text:   "one </script>",
+		},
+		{
+			name:   "put a draft",
+			method: "PUT",
+			url:    tiddlerURL("Draft of 'A: B'"),
+			body:   `{"text":"typing","fields":{"draft.of":"A: B","draft.title":"A: B"}}`,
+			auth:   true,
+			status: http.StatusNoContent,
+			text:   "typing",
+		},
+		{
+			name:    "delete a draft",
+			method:  "DELETE",
+			url:     "/wikis/notes.html/bags/default/tiddlers/" + url.PathEscape("Draft of 'A: B'"),
+			auth:    true,
+			status:  http.StatusNoContent,
+			missing: true,
+		},
+		{
+			name:   "put a changed tiddler",
+			method: "PUT",
+			url:    tiddlerURL("A: B"),
+			body:   `{"text":"two"}`,
+			auth:   true,
+			status: http.StatusNoContent,
+			events: []string{"prestore", "poststore"},
+			text:   "two",
+		},
+		{
+			name:   "delete without a login",
+			method: "DELETE",
+			url:    "/wikis/notes.html/bags/default/tiddlers/" + url.PathEscape("A: B"),
+			status: http.StatusUnauthorized,
+			text:   "two",
+		},
+		{
+			name:    "delete a tiddler",
+			method:  "DELETE",
+			url:     "/wikis/notes.html/bags/default/tiddlers/" + url.PathEscape("A: B"),
+			auth:    true,
+			status:  http.StatusNoContent,
+			events:  []string{"prestore", "poststore"},
+			missing: true,
+		},
+		{
+			name:   "delete a missing tiddler",
+			method: "DELETE",
+			url:    "/wikis/notes.html/bags/default/tiddlers/" + url.PathEscape("A: B"),
+			auth:   true,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "put into a missing wiki",
+			method: "PUT",
+			url:    "/wikis/missing.html/recipes/default/tiddlers/Title",
+			body:   `{"text":"one"}`,
+			auth:   true,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*events = []string{}
+
+			req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			if test.auth {
+				req.SetBasicAuth("tiddlygo", "tiddlygo")
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status = %v, want %v: %v", rec.Code, test.status, rec.Body.String())
+			}
+
+			if strings.Join(*events, ",") != strings.Join(test.events, ",") {
+				t.Fatalf("events = %v, want %v", *events, test.events)
+			}
+
+			if rec.Code >= 300 && test.text == "" && !test.missing {
+				return
+			}
+
+			// The tiddler is read back like the plugin does after a change
+			getURL := strings.Replace(test.url, "/bags/", "/recipes/", 1)
+			get := httptest.NewRecorder()
+			router.ServeHTTP(get, httptest.NewRequest("GET", getURL, nil))
+
+			if test.missing {
+				if get.Code != http.StatusNotFound {
+					t.Fatalf("the tiddler is still there: %v", get.Code)
+				}
+				return
+			}
+
+			if get.Code != http.StatusOK {
+				t.Fatalf("get: status = %v: %v", get.Code, get.Body.String())
+			}
+
+			data := map[string]interface{}{}
+
+			err := json.Unmarshal(get.Body.Bytes(), &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data["text"] != test.text {
+				t.Fatalf("text = %q, want %q", data["text"], test.text)
+			}
+
+			revision, _ := data["revision"].(string)
+			etag := get.Header().Get("ETag")
+
+			if revision == "" || !strings.HasSuffix(etag, "/"+revision+`:"`) {
+				t.Fatalf("the ETag %v doesn't have the revision %q", etag, revision)
+			}
+
+			if test.method == "PUT" && rec.Header().Get("ETag") != etag {
+				t.Fatalf("put ETag = %v, want the one of the stored tiddler %v", rec.Header().Get("ETag"), etag)
+			}
+		})
+	}
+}
+
+// The revision changes with any field, so the plugin sees every change
+func TestTiddlyWebRevisionChanges(t *testing.T) {
+	useTestServer(t)
+	router := getRouter()
+
+	etags := map[string]bool{}
+
+	for _, body := range []string{`{"text":"one"}`, `{"text":"two"}`, `{"text":"two","tags":"tag"}`} {
+		req := httptest.NewRequest("PUT", tiddlerURL("Tiddler"), strings.NewReader(body))
+		req.SetBasicAuth("tiddlygo", "tiddlygo")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status = %v: %v", rec.Code, rec.Body.String())
+		}
+
+		etag := rec.Header().Get("ETag")
+		if etags[etag] {
+			t.Fatalf("the ETag %v didn't change with %v", etag, body)
+		}
+
+		etags[etag] = true
+	}
+}
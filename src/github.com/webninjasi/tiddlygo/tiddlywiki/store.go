@@ -0,0 +1,276 @@
+package tiddlywiki
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var reAttr = regexp.MustCompile(`([^\s=]+)="([^"]*)"`)
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// classicFieldOrder is the order TiddlyWiki Classic writes the standard fields in
+var classicFieldOrder = []string{"title", "modifier", "created", "modified", "tags", "changecount"}
+
+// parseDivStore parses the tiddler divs starting at pos up to the end of
+// the store area and returns where the tiddlers start and end. The space
+// around them isn't part of the store, so that it's written back as it was.
+func parseDivStore(doc []byte, pos int) ([]*Tiddler, int, int, error) {
+	tiddlers := []*Tiddler{}
+	start, end := -1, pos
+
+	for {
+		for pos < len(doc) && isSpace(doc[pos]) {
+			pos++
+		}
+
+		if start < 0 {
+			start = pos
+		}
+
+		rest := doc[pos:]
+
+		if bytes.HasPrefix(rest, []byte("</div>")) {
+			if len(tiddlers) == 0 {
+				end = start
+			}
+
+			return tiddlers, start, end, nil
+		}
+
+		// Comments might appear between the tiddlers
+		if bytes.HasPrefix(rest, []byte("<!--")) {
+			commentEnd := bytes.Index(rest, []byte("-->"))
+			if commentEnd < 0 {
+				return nil, 0, 0, ErrNoStoreArea
+			}
+
+			pos += commentEnd + 3
+			continue
+		}
+
+		if !bytes.HasPrefix(rest, []byte("<div")) {
+			return nil, 0, 0, ErrNoStoreArea
+		}
+
+		tagEnd := bytes.IndexByte(rest, '>')
+		if tagEnd < 0 {
+			return nil, 0, 0, ErrNoStoreArea
+		}
+
+		fields := map[string]string{}
+
+		for _, attr := range reAttr.FindAllSubmatch(rest[4:tagEnd], -1) {
+			fields[string(attr[1])] = html.UnescapeString(string(attr[2]))
+		}
+
+		body := rest[tagEnd+1:]
+		var n int
+
+		// The text is inside a <pre>, except in old TiddlyWiki Classic files
+		trimmed := bytes.TrimLeft(body, " \t\r\n")
+		if bytes.HasPrefix(trimmed, []byte("<pre>")) {
+			start := len(body) - len(trimmed) + 5
+
+			preEnd := bytes.Index(body[start:], []byte("</pre>"))
+			if preEnd < 0 {
+				return nil, 0, 0, ErrNoStoreArea
+			}
+
+			text := string(body[start : start+preEnd])
+			fields["text"] = html.UnescapeString(text)
+
+			divEnd := bytes.Index(body[start+preEnd:], []byte("</div>"))
+			if divEnd < 0 {
+				return nil, 0, 0, ErrNoStoreArea
+			}
+
+			n = start + preEnd + divEnd + 6
+		} else {
+			divEnd := bytes.Index(body, []byte("</div>"))
+			if divEnd < 0 {
+				return nil, 0, 0, ErrNoStoreArea
+			}
+
+			fields["text"] = unescapeLineBreaks(html.UnescapeString(string(body[:divEnd])))
+			n = divEnd + 6
+		}
+
+		pos += tagEnd + 1 + n
+		end = pos
+
+		if _, ok := fields["title"]; !ok {
+			continue
+		}
+
+		if fields["text"] == "" {
+			delete(fields, "text")
+		}
+
+		tiddlers = append(tiddlers, NewTiddlerFromFields(fields))
+	}
+}
+
+func writeDivStore(buf *bytes.Buffer, tiddlers []*Tiddler, format Format) error {
+	for idx, tiddler := range tiddlers {
+		fields := tiddler.fieldMap(format)
+
+		if idx > 0 {
+			buf.WriteString("\n")
+		}
+
+		buf.WriteString("<div")
+
+		for _, name := range divFieldNames(fields, format) {
+			buf.WriteString(" " + name + `="` + htmlEscaper.Replace(fields[name]) + `"`)
+		}
+
+		buf.WriteString(">\n<pre>")
+		buf.WriteString(htmlEscaper.Replace(fields["text"]))
+		buf.WriteString("</pre>\n</div>")
+	}
+
+	return nil
+}
+
+// divFieldNames returns the names of the fields written as attributes
+func divFieldNames(fields map[string]string, format Format) []string {
+	names := []string{}
+	seen := map[string]bool{"text": true}
+
+	if format == Classic {
+		for _, name := range classicFieldOrder {
+			if _, ok := fields[name]; ok {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(fields) {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func parseJSONStore(data []byte) ([]*Tiddler, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return []*Tiddler{}, nil
+	}
+
+	list := []map[string]interface{}{}
+
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	tiddlers := []*Tiddler{}
+
+	for _, raw := range list {
+		fields := map[string]string{}
+
+		for name, value := range raw {
+			fields[name] = jsonFieldString(value)
+		}
+
+		if _, ok := fields["title"]; !ok {
+			continue
+		}
+
+		tiddlers = append(tiddlers, NewTiddlerFromFields(fields))
+	}
+
+	return tiddlers, nil
+}
+
+// jsonFieldString converts a JSON field to the string TiddlyWiki would use
+func jsonFieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			list = append(list, jsonFieldString(item))
+		}
+		return StringifyList(list)
+	case nil:
+		return ""
+	}
+
+	data, _ := json.Marshal(value)
+
+	return string(data)
+}
+
+// writeJSONStore writes one tiddler per line like TiddlyWiki5 does
+func writeJSONStore(buf *bytes.Buffer, tiddlers []*Tiddler) error {
+	buf.WriteString("[")
+
+	for idx, tiddler := range tiddlers {
+		data, err := json.Marshal(tiddler.Map())
+		if err != nil {
+			return err
+		}
+
+		if idx > 0 {
+			buf.WriteString(",")
+		}
+
+		buf.WriteString("\n")
+		buf.Write(data)
+	}
+
+	buf.WriteString("\n]")
+
+	return nil
+}
+
+// unescapeLineBreaks decodes the text of old TiddlyWiki Classic tiddlers
+func unescapeLineBreaks(text string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			switch text[i+1] {
+			case 'n':
+				buf.WriteByte('\n')
+				i++
+				continue
+			case 's':
+				buf.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+
+		buf.WriteByte(text[i])
+	}
+
+	return buf.String()
+}
+
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,121 @@
+package tiddlywiki
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNoTitle = errors.New("The tiddler has no title!")
+)
+
+// ParseTid reads a tiddler in the .tid file format of TiddlyWiki5:
+// "name: value" lines, an empty line and then the text
+func ParseTid(data []byte) (*Tiddler, error) {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+
+	header := data
+	text := []byte{}
+
+	if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+		header, text = data[:idx], data[idx+2:]
+	}
+
+	fields := ParseFields(header)
+	if _, ok := fields["title"]; !ok {
+		return nil, ErrNoTitle
+	}
+
+	if len(text) > 0 {
+		fields["text"] = string(text)
+	}
+
+	return NewTiddlerFromFields(fields), nil
+}
+
+// ParseFields reads "name: value" lines like the header of a .tid file
+func ParseFields(data []byte) map[string]string {
+	fields := map[string]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+
+		fields[name] = value
+	}
+
+	return fields
+}
+
+// Tid returns the tiddler in the .tid file format. It fails for the tiddlers
+// which can't be written in that format, e.g. if a field has line breaks.
+func (this *Tiddler) Tid() ([]byte, bool) {
+	header, ok := this.MetaFields()
+	if !ok || strings.Contains(this.Text, "\r") {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+
+	buf.Write(header)
+
+	if this.Text != "" {
+		buf.WriteString("\n")
+		buf.WriteString(this.Text)
+	}
+
+	return buf.Bytes(), true
+}
+
+// MetaFields returns every field except the text as "name: value" lines
+func (this *Tiddler) MetaFields() ([]byte, bool) {
+	var buf bytes.Buffer
+
+	for _, name := range this.FieldNames() {
+		if name == "text" {
+			continue
+		}
+
+		value := this.Field(name)
+
+		if strings.ContainsAny(name, ":\n\r") || name == "" || strings.ContainsAny(value, "\n\r") ||
+			value != strings.TrimSpace(value) {
+			return nil, false
+		}
+
+		buf.WriteString(name + ": " + value + "\n")
+	}
+
+	return buf.Bytes(), true
+}
+
+// ParseJSON reads tiddlers from a JSON array of field objects
+func ParseJSON(data []byte) ([]*Tiddler, error) {
+	return parseJSONStore(data)
+}
+
+// FieldString converts a JSON field value to the string TiddlyWiki would use,
+// e.g. a list of tags
+func FieldString(value interface{}) string {
+	return jsonFieldString(value)
+}
+
+// JSON returns the tiddlers as a JSON array with a tiddler per line
+func JSON(tiddlers []*Tiddler) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := writeJSONStore(&buf, tiddlers)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
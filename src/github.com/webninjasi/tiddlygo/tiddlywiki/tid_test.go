@@ -0,0 +1,86 @@
+package tiddlywiki
+
+import (
+	"testing"
+)
+
+func TestTidRoundTrip(t *testing.T) {
+	tiddler := NewTiddler("Title: with a colon")
+	tiddler.Text = "first: not a field\n\nsecond paragraph </script>"
+	tiddler.Tags = []string{"one", "two words"}
+	tiddler.SetField("url", "http://example.com/a:b")
+
+	data, ok := tiddler.Tid()
+	if !ok {
+		t.Fatal("the tiddler can't be written as a .tid file")
+	}
+
+	got, err := ParseTid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"title", "text", "tags", "url"} {
+		if got.Field(name) != tiddler.Field(name) {
+			t.Errorf("field %v = %q, want %q", name, got.Field(name), tiddler.Field(name))
+		}
+	}
+}
+
+func TestTidRefusesLineBreaks(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		value string
+	}{
+		{"line break in a field", "caption", "first\nsecond"},
+		{"carriage return in a field", "caption", "first\rsecond"},
+		{"colon in a field name", "a:b", "value"},
+		{"leading space in a field", "caption", " value"},
+		{"line break in the title", "title", "first\nsecond"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tiddler := NewTiddler("Tiddler")
+			tiddler.SetField(test.field, test.value)
+
+			if _, ok := tiddler.Tid(); ok {
+				t.Fatalf("%v = %q was written as a .tid file", test.field, test.value)
+			}
+		})
+	}
+}
+
+func TestParseTidWithoutTitle(t *testing.T) {
+	_, err := ParseTid([]byte("tags: one\n\ntext"))
+	if err != ErrNoTitle {
+		t.Fatalf("got %v, want %v", err, ErrNoTitle)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tiddler := NewTiddler("A: B </script>")
+	tiddler.Text = "line one\nline two </script>"
+	tiddler.SetField("caption", "first\nsecond")
+
+	data, err := JSON([]*Tiddler{tiddler})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiddlers, err := ParseJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tiddlers) != 1 {
+		t.Fatalf("%v tiddlers, want 1", len(tiddlers))
+	}
+
+	for _, name := range []string{"title", "text", "caption"} {
+		if tiddlers[0].Field(name) != tiddler.Field(name) {
+			t.Errorf("field %v = %q, want %q", name, tiddlers[0].Field(name), tiddler.Field(name))
+		}
+	}
+}
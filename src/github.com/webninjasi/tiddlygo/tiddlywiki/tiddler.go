@@ -0,0 +1,287 @@
+package tiddlywiki
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	c_dateFormat        = "20060102150405.000"
+	c_classicDateFormat = "200601021504"
+)
+
+type Tiddler struct {
+	Title    string
+	Text     string
+	Tags     []string
+	Created  time.Time
+	Modified time.Time
+
+	// Fields holds every other field, e.g. type, modifier or custom fields
+	Fields map[string]string
+}
+
+func NewTiddler(title string) *Tiddler {
+	return &Tiddler{
+		Title:  title,
+		Tags:   []string{},
+		Fields: map[string]string{},
+	}
+}
+
+// NewTiddlerFromFields builds a tiddler from its raw string fields
+func NewTiddlerFromFields(fields map[string]string) *Tiddler {
+	tiddler := NewTiddler(fields["title"])
+
+	for name, value := range fields {
+		tiddler.SetField(name, value)
+	}
+
+	return tiddler
+}
+
+// Field returns the string value of a field as it is stored in a wiki
+func (this *Tiddler) Field(name string) string {
+	return this.field(name, Wiki5)
+}
+
+func (this *Tiddler) field(name string, format Format) string {
+	switch name {
+	case "title":
+		return this.Title
+	case "text":
+		return this.Text
+	case "tags":
+		return StringifyList(this.Tags)
+	case "created":
+		if !this.Created.IsZero() {
+			return FormatDate(this.Created, format)
+		}
+	case "modified":
+		if !this.Modified.IsZero() {
+			return FormatDate(this.Modified, format)
+		}
+	}
+
+	return this.Fields[name]
+}
+
+// SetField sets a field from its string value as it is stored in a wiki
+func (this *Tiddler) SetField(name string, value string) {
+	if this.Fields == nil {
+		this.Fields = map[string]string{}
+	}
+
+	switch name {
+	case "title":
+		this.Title = value
+		return
+	case "text":
+		this.Text = value
+		return
+	case "tags":
+		this.Tags = ParseList(value)
+		return
+	case "created", "modified":
+		// Dates which can't be parsed are kept as they are
+		t, err := ParseDate(value)
+		if err != nil {
+			break
+		}
+
+		if name == "created" {
+			this.Created = t
+		} else {
+			this.Modified = t
+		}
+
+		delete(this.Fields, name)
+		return
+	}
+
+	this.Fields[name] = value
+}
+
+// FieldNames returns the names of the fields that have a value, sorted
+func (this *Tiddler) FieldNames() []string {
+	names := []string{"title"}
+
+	if this.Text != "" {
+		names = append(names, "text")
+	}
+
+	if len(this.Tags) > 0 {
+		names = append(names, "tags")
+	}
+
+	if !this.Created.IsZero() {
+		names = append(names, "created")
+	}
+
+	if !this.Modified.IsZero() {
+		names = append(names, "modified")
+	}
+
+	for name := range this.Fields {
+		switch name {
+		case "title", "text", "tags":
+			continue
+		case "created", "modified":
+			if this.Field(name) != this.Fields[name] {
+				continue
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Map returns all fields of the tiddler as strings
+func (this *Tiddler) Map() map[string]string {
+	return this.fieldMap(Wiki5)
+}
+
+func (this *Tiddler) fieldMap(format Format) map[string]string {
+	fields := map[string]string{}
+
+	for _, name := range this.FieldNames() {
+		fields[name] = this.field(name, format)
+	}
+
+	return fields
+}
+
+// Clone returns a deep copy of the tiddler
+func (this *Tiddler) Clone() *Tiddler {
+	clone := *this
+
+	clone.Tags = append([]string{}, this.Tags...)
+	clone.Fields = map[string]string{}
+
+	for name, value := range this.Fields {
+		clone.Fields[name] = value
+	}
+
+	return &clone
+}
+
+// HasTag reports whether the tiddler is tagged with tag
+func (this *Tiddler) HasTag(tag string) bool {
+	for _, t := range this.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSystem reports whether it is a system tiddler ($:/...)
+func (this *Tiddler) IsSystem() bool {
+	return strings.HasPrefix(this.Title, "$:/")
+}
+
+// ParseDate parses a TiddlyWiki date (YYYYMMDDHHMMSSmmm in UTC).
+// The shorter dates of TiddlyWiki Classic are accepted too.
+func ParseDate(value string) (time.Time, error) {
+	switch len(value) {
+	case 12:
+		return time.Parse(c_classicDateFormat, value)
+	case 14:
+		return time.Parse("20060102150405", value)
+	}
+
+	if len(value) == 17 {
+		value = value[:14] + "." + value[14:]
+	}
+
+	return time.Parse(c_dateFormat, value)
+}
+
+// FormatDate formats a date the way the given wiki format stores it
+func FormatDate(t time.Time, format Format) string {
+	t = t.UTC()
+
+	if format == Classic {
+		return t.Format(c_classicDateFormat)
+	}
+
+	return strings.Replace(t.Format(c_dateFormat), ".", "", 1)
+}
+
+// ParseList parses a TiddlyWiki list like tags: "one [[two words]] three"
+func ParseList(value string) []string {
+	list := []string{}
+	seen := map[string]bool{}
+
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " \t\n\r")
+		if value == "" {
+			break
+		}
+
+		var item string
+
+		if strings.HasPrefix(value, "[[") {
+			end := listItemEnd(value)
+			if end < 0 {
+				item, value = value[2:], ""
+			} else {
+				item, value = value[2:end], value[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(value, " \t\n\r")
+			if end < 0 {
+				item, value = value, ""
+			} else {
+				item, value = value[:end], value[end:]
+			}
+		}
+
+		if !seen[item] {
+			seen[item] = true
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// listItemEnd returns the position of the "]]" which closes the item at the
+// start of the value. Like in TiddlyWiki it must be followed by a space or
+// the end, so the items may have brackets themselves.
+func listItemEnd(value string) int {
+	for pos := 2; ; {
+		idx := strings.Index(value[pos:], "]]")
+		if idx < 0 {
+			return -1
+		}
+
+		end := pos + idx
+		if end+2 == len(value) || strings.ContainsAny(value[end+2:end+3], " \t\n\r") {
+			return end
+		}
+
+		pos = end + 1
+	}
+}
+
+// StringifyList is the reverse of ParseList
+func StringifyList(list []string) string {
+	items := make([]string, len(list))
+
+	for idx, item := range list {
+		if item == "" || strings.ContainsAny(item, " \t\n\r") || strings.HasPrefix(item, "[[") {
+			item = "[[" + item + "]]"
+		}
+
+		items[idx] = item
+	}
+
+	return strings.Join(items, " ")
+}
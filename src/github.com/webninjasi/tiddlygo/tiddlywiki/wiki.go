@@ -0,0 +1,210 @@
+// Package tiddlywiki reads and writes the tiddlers stored in TiddlyWiki
+// html files, both TiddlyWiki Classic and TiddlyWiki5.
+package tiddlywiki
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+)
+
+type Format int
+
+const (
+	Classic Format = iota
+	Wiki5
+)
+
+var (
+	ErrNoStoreArea = errors.New("Couldn't find the store area of the wiki!")
+	ErrEncrypted   = errors.New("The wiki is encrypted!")
+)
+
+type storeKind int
+
+const (
+	divStore storeKind = iota
+	jsonStore
+)
+
+// storeArea is the position of a store's content within the document
+type storeArea struct {
+	kind  storeKind
+	start int
+	end   int
+}
+
+type Wiki struct {
+	Format Format
+
+	doc      []byte
+	stores   []storeArea
+	tiddlers map[string]*Tiddler
+	order    []string
+}
+
+var (
+	reVersion5  = regexp.MustCompile(`<meta\s+name="tiddlywiki-version"`)
+	reJSONStore = regexp.MustCompile(`<script\s[^>]*class="tiddlywiki-tiddler-store"[^>]*>`)
+	reDivStore  = regexp.MustCompile(`<div\s[^>]*id="storeArea"[^>]*>`)
+	reEncrypted = regexp.MustCompile(`<pre\s[^>]*id="encryptedStoreArea"`)
+)
+
+// Parse reads the tiddlers of a TiddlyWiki html document
+func Parse(doc []byte) (*Wiki, error) {
+	wiki := &Wiki{
+		Format:   Classic,
+		doc:      doc,
+		tiddlers: map[string]*Tiddler{},
+	}
+
+	if reVersion5.Match(doc) || reJSONStore.Match(doc) {
+		wiki.Format = Wiki5
+	}
+
+	if reEncrypted.Match(doc) {
+		return nil, ErrEncrypted
+	}
+
+	loc := reDivStore.FindIndex(doc)
+	if loc != nil {
+		tiddlers, start, end, err := parseDivStore(doc, loc[1])
+		if err != nil {
+			return nil, err
+		}
+
+		wiki.stores = append(wiki.stores, storeArea{divStore, start, end})
+		wiki.add(tiddlers)
+	}
+
+	// Later stores override the earlier ones, the same way TiddlyWiki loads them
+	for _, loc := range reJSONStore.FindAllIndex(doc, -1) {
+		end := bytes.Index(doc[loc[1]:], []byte("</script>"))
+		if end < 0 {
+			return nil, ErrNoStoreArea
+		}
+
+		end += loc[1]
+
+		tiddlers, err := parseJSONStore(doc[loc[1]:end])
+		if err != nil {
+			return nil, err
+		}
+
+		wiki.stores = append(wiki.stores, storeArea{jsonStore, loc[1], end})
+		wiki.add(tiddlers)
+	}
+
+	if len(wiki.stores) == 0 {
+		return nil, ErrNoStoreArea
+	}
+
+	sort.Slice(wiki.stores, func(i, j int) bool {
+		return wiki.stores[i].start < wiki.stores[j].start
+	})
+
+	return wiki, nil
+}
+
+func (this *Wiki) add(tiddlers []*Tiddler) {
+	for _, tiddler := range tiddlers {
+		this.Put(tiddler)
+	}
+}
+
+// Tiddlers returns the tiddlers of the wiki in the order they are stored
+func (this *Wiki) Tiddlers() []*Tiddler {
+	tiddlers := make([]*Tiddler, 0, len(this.order))
+
+	for _, title := range this.order {
+		tiddlers = append(tiddlers, this.tiddlers[title])
+	}
+
+	return tiddlers
+}
+
+// Tiddler returns the tiddler with the given title or nil
+func (this *Wiki) Tiddler(title string) *Tiddler {
+	return this.tiddlers[title]
+}
+
+// Put adds a tiddler or replaces the one with the same title
+func (this *Wiki) Put(tiddler *Tiddler) {
+	if _, ok := this.tiddlers[tiddler.Title]; !ok {
+		this.order = append(this.order, tiddler.Title)
+	}
+
+	this.tiddlers[tiddler.Title] = tiddler
+}
+
+// Delete removes a tiddler and reports whether it existed
+func (this *Wiki) Delete(title string) bool {
+	if _, ok := this.tiddlers[title]; !ok {
+		return false
+	}
+
+	delete(this.tiddlers, title)
+
+	for idx, t := range this.order {
+		if t == title {
+			this.order = append(this.order[:idx], this.order[idx+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// primaryStore is where the tiddlers are written: the store area TiddlyWiki
+// itself would save into, which is the JSON store for newer TiddlyWiki5 files
+func (this *Wiki) primaryStore() int {
+	for idx, store := range this.stores {
+		if store.kind == jsonStore {
+			return idx
+		}
+	}
+
+	return 0
+}
+
+// Bytes returns the html document with the current tiddlers in its store area.
+// Everything outside of the store areas is kept as it was.
+func (this *Wiki) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	primary := this.primaryStore()
+	tiddlers := this.Tiddlers()
+	pos := 0
+
+	for idx, store := range this.stores {
+		buf.Write(this.doc[pos:store.start])
+		pos = store.end
+
+		if idx != primary {
+			// Every tiddler has moved into the primary store
+			if store.kind == jsonStore {
+				buf.WriteString("[]")
+			}
+
+			continue
+		}
+
+		var err error
+
+		switch store.kind {
+		case jsonStore:
+			err = writeJSONStore(&buf, tiddlers)
+		default:
+			err = writeDivStore(&buf, tiddlers, this.Format)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf.Write(this.doc[pos:])
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,214 @@
+package tiddlywiki
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const c_templateFile = "../../../../../templates/tiddlywiki-5.1.11.html"
+
+var rePlaceholder = regexp.MustCompile(`<!--## \w+ ##-->`)
+
+const c_jsonStoreDoc = `<!doctype html>
+<html>
+<head>
+<meta name="tiddlywiki-version" content="5.3.0">
+</head>
+<body>
+<script class="tiddlywiki-tiddler-store" type="application/json">[
+{"title":"First","text":"one"}
+]</script>
+<div id="storeArea" style="display:none;"></div>
+</body>
+</html>
+`
+
+const c_classicDoc = `<html>
+<body>
+<div id="storeArea">
+<div title="First" modifier="alice" created="200601021504" tags="">
+<pre>one</pre>
+</div>
+</div>
+</body>
+</html>
+`
+
+// readTemplate reads the bundled template with its placeholders filled in
+// like a new wiki, they aren't escaped like the rest of the tiddlers
+func readTemplate(t *testing.T) []byte {
+	doc, err := ioutil.ReadFile(c_templateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rePlaceholder.ReplaceAll(doc, []byte("Notes"))
+}
+
+func TestTemplateRoundTrip(t *testing.T) {
+	doc := readTemplate(t)
+
+	wiki, err := Parse(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wiki.Format != Wiki5 {
+		t.Fatalf("format = %v, want Wiki5", wiki.Format)
+	}
+
+	if len(wiki.Tiddlers()) == 0 {
+		t.Fatal("no tiddlers were read from the template")
+	}
+
+	out, err := wiki.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out, doc) {
+		t.Fatalf("the template changed after a round trip, at byte %v", firstDifference(out, doc))
+	}
+}
+
+// Changing a single tiddler must leave the rest of the document alone
+func TestTemplatePutKeepsTheRest(t *testing.T) {
+	doc := readTemplate(t)
+
+	wiki, err := Parse(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := len(wiki.Tiddlers())
+
+	wiki.Put(NewTiddler("New Tiddler"))
+
+	out, err := wiki.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wiki, err = Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wiki.Tiddlers()) != count+1 {
+		t.Fatalf("%v tiddlers after the put, want %v", len(wiki.Tiddlers()), count+1)
+	}
+
+	if !wiki.Delete("New Tiddler") {
+		t.Fatal("the new tiddler wasn't read back")
+	}
+
+	again, err := wiki.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again, doc) {
+		t.Fatalf("the template changed after a put and a delete, at byte %v", firstDifference(again, doc))
+	}
+}
+
+func TestSpecialCharacters(t *testing.T) {
+	tiddler := NewTiddler("A: B </script> & <div>")
+	tiddler.Text = "line one\nline two\r\n</script></div></pre>\t\"quoted\" 'single' &amp;"
+	tiddler.Tags = []string{"with space", "[[brackets]]"}
+	tiddler.SetField("caption", "first\nsecond")
+	tiddler.SetField("url", "http://example.com/?a=1&b=\"2\"")
+	tiddler.SetField("script", "</script><script>alert(1)</script>")
+
+	docs := []struct {
+		name   string
+		doc    string
+		marker string
+	}{
+		{"json store", c_jsonStoreDoc, `class="tiddlywiki-tiddler-store"`},
+		{"classic div store", c_classicDoc, `id="storeArea"`},
+	}
+
+	for _, test := range docs {
+		t.Run(test.name, func(t *testing.T) {
+			wiki, err := Parse([]byte(test.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wiki.Put(tiddler.Clone())
+
+			out, err := wiki.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing the tiddler has may end the store area early
+			if n := strings.Count(string(out), "</script>"); n != strings.Count(test.doc, "</script>") {
+				t.Fatalf("the document has %v </script> tags after the put", n)
+			}
+
+			if !strings.Contains(string(out), test.marker) {
+				t.Fatal("the store area is gone")
+			}
+
+			parsed, err := Parse(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := parsed.Tiddler(tiddler.Title)
+			if got == nil {
+				t.Fatalf("no tiddler titled %q after the round trip", tiddler.Title)
+			}
+
+			if got.Text != tiddler.Text {
+				t.Errorf("text = %q, want %q", got.Text, tiddler.Text)
+			}
+
+			for _, name := range []string{"tags", "caption", "url", "script"} {
+				if got.Field(name) != tiddler.Field(name) {
+					t.Errorf("field %v = %q, want %q", name, got.Field(name), tiddler.Field(name))
+				}
+			}
+
+			if first := parsed.Tiddler("First"); first == nil || first.Text != "one" {
+				t.Error("the other tiddler changed")
+			}
+
+			// A second round trip writes the same bytes
+			again, err := parsed.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(again, out) {
+				t.Fatalf("the second round trip differs at byte %v", firstDifference(again, out))
+			}
+		})
+	}
+}
+
+func TestParseWithoutStoreArea(t *testing.T) {
+	_, err := Parse([]byte("<html><body></body></html>"))
+	if err != ErrNoStoreArea {
+		t.Fatalf("got %v, want %v", err, ErrNoStoreArea)
+	}
+}
+
+func firstDifference(a []byte, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	if len(a) < len(b) {
+		return len(a)
+	}
+
+	return len(b)
+}
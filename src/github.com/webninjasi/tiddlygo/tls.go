@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-signed certificates are made for this long
+const c_selfSignedLifetime = 2 * 365 * 24 * time.Hour
+
+type TLSConfig struct {
+	Enabled         bool     `json:"enabled"`
+	CertFile        string   `json:"certfile"`
+	KeyFile         string   `json:"keyfile"`
+	SelfSigned      bool     `json:"selfsigned"`
+	Hosts           []string `json:"hosts"`
+	RedirectAddress string   `json:"redirectaddress"`
+	HSTS            string   `json:"hsts"`
+}
+
+// certLoader gives the certificate of the files to the handshakes,
+// they're read again whenever one of them changes
+type certLoader struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	size     int64
+	cert     *tls.Certificate
+}
+
+func NewTLSConfig() TLSConfig {
+	return TLSConfig{
+		Enabled:         false,
+		CertFile:        "tiddlygo.crt",
+		KeyFile:         "tiddlygo.key",
+		SelfSigned:      false,
+		Hosts:           []string{},
+		RedirectAddress: "",
+		HSTS:            "",
+	}
+}
+
+// stat returns the latest modification time and the total size of the files
+func (this *certLoader) stat() (time.Time, int64, error) {
+	var modTime time.Time
+	var size int64
+
+	for _, filename := range []string{this.certFile, this.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+
+		size += info.Size()
+	}
+
+	return modTime, size, nil
+}
+
+// GetCertificate keeps using the last certificate if the new files can't be
+// loaded, e.g. while they're being replaced
+func (this *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	modTime, size, err := this.stat()
+	if err == nil && this.cert != nil && this.modTime.Equal(modTime) && this.size == size {
+		return this.cert, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+
+		cert, err = tls.LoadX509KeyPair(this.certFile, this.keyFile)
+		if err == nil {
+			if this.cert != nil {
+				log.Println("Loaded the changed TLS certificate")
+			}
+
+			this.modTime = modTime
+			this.size = size
+			this.cert = &cert
+
+			return this.cert, nil
+		}
+	}
+
+	if this.cert != nil {
+		log.Println("Error while loading the TLS certificate:", err)
+		return this.cert, nil
+	}
+
+	return nil, err
+}
+
+// newTLSConfig checks the certificate files, and makes them first if a
+// self-signed certificate is wanted and there is none yet
+func newTLSConfig(conf TLSConfig) (*tls.Config, error) {
+	if conf.SelfSigned && !isExist(conf.CertFile) && !isExist(conf.KeyFile) {
+		err := writeSelfSignedCert(conf.CertFile, conf.KeyFile, tlsHosts(conf))
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Created a self-signed certificate in '%v'\n", conf.CertFile)
+	}
+
+	loader := &certLoader{
+		certFile: conf.CertFile,
+		keyFile:  conf.KeyFile,
+	}
+
+	_, err := loader.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.GetCertificate,
+	}, nil
+}
+
+// tlsHosts returns the names of a self-signed certificate, by default the
+// ones the server can be reached at on this computer and the local network
+func tlsHosts(conf TLSConfig) []string {
+	if len(conf.Hosts) > 0 {
+		return conf.Hosts
+	}
+
+	hosts := []string{"localhost"}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return append(hosts, "127.0.0.1", "::1")
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			hosts = append(hosts, ipnet.IP.String())
+		}
+	}
+
+	return hosts
+}
+
+func writeSelfSignedCert(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"TiddlyGo"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(c_selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// hstsHandler tells the browsers to use HTTPS only for the given time
+func hstsHandler(next http.Handler, maxAge time.Duration) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS address
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		if strings.Contains(host, ":") {
+			// An IPv6 address
+			host = "[" + host + "]"
+		}
+
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// listen serves the router on the address of the config,
+// with HTTPS and its redirect listener if it's enabled
+func listen(router http.Handler) error {
+	conf := cfg()
+
+	if !conf.TLS.Enabled {
+		log.Println("Listening the server on", conf.Address)
+		return http.ListenAndServe(conf.Address, router)
+	}
+
+	tlsConfig, err := newTLSConfig(conf.TLS)
+	if err != nil {
+		return err
+	}
+
+	if conf.TLS.HSTS != "" {
+		maxAge, err := time.ParseDuration(conf.TLS.HSTS)
+		if err != nil {
+			return fmt.Errorf("invalid hsts duration: %v", err)
+		}
+
+		router = hstsHandler(router, maxAge)
+	}
+
+	if conf.TLS.RedirectAddress != "" {
+		go func() {
+			log.Println("Redirecting HTTP to HTTPS on", conf.TLS.RedirectAddress)
+
+			err := http.ListenAndServe(conf.TLS.RedirectAddress, redirectHandler(conf.Address))
+			if err != nil {
+				log.Println("Error while listening for HTTP redirects:", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      conf.Address,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Println("Listening the server with HTTPS on", conf.Address)
+
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// parseCert returns the certificate which is sent to the clients
+func parseCert(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tiddlygo.crt"), filepath.Join(dir, "tiddlygo.key")
+
+	tlsConfig, err := newTLSConfig(TLSConfig{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		SelfSigned: true,
+		Hosts:      []string{"wiki.lan", "10.0.0.2", "::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("stat of the key = %v, %v, want it readable only by the owner", info, err)
+	}
+
+	cert, err := tlsConfig.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := parseCert(t, cert)
+
+	for _, host := range []string{"wiki.lan", "10.0.0.2", "::1"} {
+		if err := parsed.VerifyHostname(host); err != nil {
+			t.Errorf("the certificate isn't for %v: %v", host, err)
+		}
+	}
+
+	if err := parsed.VerifyHostname("other.lan"); err == nil {
+		t.Error("the certificate is for a host which wasn't asked for")
+	}
+
+	if parsed.NotAfter.Before(time.Now().Add(c_selfSignedLifetime - time.Hour)) {
+		t.Errorf("the certificate expires at %v", parsed.NotAfter)
+	}
+
+	// An existing certificate is kept
+	before, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, SelfSigned: true, Hosts: []string{"other.lan"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := ioutil.ReadFile(certFile); string(after) != string(before) {
+		t.Fatal("the existing certificate was replaced")
+	}
+
+	// Without a self-signed one the files must be there
+	_, err = newTLSConfig(TLSConfig{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile})
+	if err == nil {
+		t.Fatal("a missing certificate was used")
+	}
+}
+
+func TestCertLoaderReload(t *testing.T) {
+	dir := t.TempDir()
+	loader := &certLoader{certFile: filepath.Join(dir, "tiddlygo.crt"), keyFile: filepath.Join(dir, "tiddlygo.key")}
+
+	if _, err := loader.GetCertificate(nil); err == nil {
+		t.Fatal("a certificate was loaded without the files")
+	}
+
+	// writeCert writes a certificate for the host with a later
+	// modification time, so it's seen as changed
+	modTime := time.Now()
+	writeCert := func(host string) {
+		err := writeSelfSignedCert(loader.certFile, loader.keyFile, []string{host})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modTime = modTime.Add(time.Minute)
+
+		for _, filename := range []string{loader.certFile, loader.keyFile} {
+			if err := os.Chtimes(filename, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeCert("one.lan")
+
+	first, err := loader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := loader.GetCertificate(nil); again != first {
+		t.Fatal("the unchanged certificate was loaded again")
+	}
+
+	writeCert("two.lan")
+
+	second, err := loader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parseCert(t, second).VerifyHostname("two.lan") != nil {
+		t.Fatal("the changed certificate wasn't loaded")
+	}
+
+	// A broken or missing certificate keeps the last one in use
+	err = ioutil.WriteFile(loader.certFile, []byte("broken"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err := loader.GetCertificate(nil); err != nil || cert != second {
+		t.Fatalf("broken certificate: got %v, want the last one", err)
+	}
+
+	os.Remove(loader.certFile)
+
+	if cert, err := loader.GetCertificate(nil); err != nil || cert != second {
+		t.Fatalf("missing certificate: got %v, want the last one", err)
+	}
+
+	writeCert("three.lan")
+
+	if cert, _ := loader.GetCertificate(nil); parseCert(t, cert).VerifyHostname("three.lan") != nil {
+		t.Fatal("the replaced certificate wasn't loaded")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		addr     string
+		host     string
+		uri      string
+		location string
+	}{
+		{":443", "wiki.lan", "/", "https://wiki.lan/"},
+		{":443", "wiki.lan:80", "/wikis/notes.html?rev=2&x=a%20b", "https://wiki.lan/wikis/notes.html?rev=2&x=a%20b"},
+		{":8443", "wiki.lan:8080", "/login?next=%2Fwikis%2F", "https://wiki.lan:8443/login?next=%2Fwikis%2F"},
+		{"10.0.0.2:8443", "10.0.0.2:8080", "/a%2Fb", "https://10.0.0.2:8443/a%2Fb"},
+		{":8443", "[::1]:8080", "/new", "https://[::1]:8443/new"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.uri, nil)
+		req.Host = test.host
+
+		rec := httptest.NewRecorder()
+		redirectHandler(test.addr).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusMovedPermanently {
+			t.Errorf("%v%v: status = %v", test.host, test.uri, rec.Code)
+		}
+
+		if location := rec.Header().Get("Location"); location != test.location {
+			t.Errorf("%v%v: location = %v, want %v", test.host, test.uri, location, test.location)
+		}
+	}
+}
+
+func TestHSTSHandler(t *testing.T) {
+	handler := hstsHandler(http.NotFoundHandler(), 24*time.Hour)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Header().Get("Strict-Transport-Security") != "" {
+		t.Fatal("HSTS was sent without HTTPS")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if value := rec.Header().Get("Strict-Transport-Security"); value != "max-age=86400" {
+		t.Fatalf("HSTS = %q", value)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API tokens look like "tgo_<id>_<secret>", the id finds the token
+// and only a hash of the secret is kept
+const c_tokenPrefix = "tgo_"
+
+var (
+	ErrInvalidScope   = errors.New("The scope of a token must be read or write!")
+	ErrTokenNotFound  = errors.New("There is no token with that id!")
+	ErrInvalidExpires = errors.New("The expiry must be a duration like 720h!")
+)
+
+// APIToken lets scripts act as its user without the password. It can't do
+// more than its scope, only on its wikis if there are any, and not at all
+// once it expires. Tokens of users from the identity provider keep the
+// groups the user had when they were created.
+type APIToken struct {
+	Id       string     `json:"id"`
+	User     string     `json:"user"`
+	Name     string     `json:"name"`
+	Scope    Role       `json:"scope"`
+	Wikis    []string   `json:"wikis,omitempty"`
+	Groups   []string   `json:"groups,omitempty"`
+	External bool       `json:"external,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// TokenFile is the JSON file which holds the API tokens by id
+type TokenFile struct {
+	Tokens map[string]APIToken `json:"tokens"`
+}
+
+// The token file is read again whenever it changes, like the user file
+var tokenCache = struct {
+	sync.Mutex
+	filename string
+	modTime  time.Time
+	size     int64
+	tokens   *TokenFile
+}{}
+
+// tokenLock is held while the API changes the token file
+var tokenLock sync.Mutex
+
+func NewTokenFile() *TokenFile {
+	return &TokenFile{
+		Tokens: map[string]APIToken{},
+	}
+}
+
+// ReadTokenFile reads the API tokens, a missing file has none
+func ReadTokenFile(filename string) (*TokenFile, error) {
+	tokens := NewTokenFile()
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens.Tokens == nil {
+		tokens.Tokens = map[string]APIToken{}
+	}
+
+	return tokens, nil
+}
+
+// WriteFile writes the tokens readable only by the owner
+func (this *TokenFile) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(this, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+// Add creates a token from the given one and returns its secret,
+// which isn't kept anywhere
+func (this *TokenFile) Add(token APIToken) (APIToken, string, error) {
+	if token.Scope != RoleRead && token.Scope != RoleWrite {
+		return APIToken{}, "", ErrInvalidScope
+	}
+
+	id := make([]byte, 8)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+
+	token.Id = hex.EncodeToString(id)
+	token.Hash = hashTokenSecret(secret)
+	token.Created = time.Now().UTC()
+
+	this.Tokens[token.Id] = token
+
+	return token, c_tokenPrefix + token.Id + "_" + secret, nil
+}
+
+func (this *TokenFile) Remove(id string) error {
+	if _, ok := this.Tokens[id]; !ok {
+		return ErrTokenNotFound
+	}
+
+	delete(this.Tokens, id)
+
+	return nil
+}
+
+// Check returns the token of a secret if it's valid and hasn't expired
+func (this *TokenFile) Check(value string) (APIToken, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(value, c_tokenPrefix), "_", 2)
+	if !strings.HasPrefix(value, c_tokenPrefix) || len(parts) != 2 {
+		return APIToken{}, false
+	}
+
+	token, ok := this.Tokens[parts[0]]
+	if !ok {
+		return APIToken{}, false
+	}
+
+	hash := hashTokenSecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 {
+		return APIToken{}, false
+	}
+
+	if token.Expires != nil && time.Now().After(*token.Expires) {
+		return APIToken{}, false
+	}
+
+	return token, true
+}
+
+// The secrets are random, so a fast hash is enough for them
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Limit returns what is left of a role on a wiki when it's used with the token
+func (this APIToken) Limit(wikiname string, role Role) Role {
+	if len(this.Wikis) > 0 {
+		allowed := false
+
+		for _, name := range this.Wikis {
+			if name == wikiname {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return RoleNone
+		}
+	}
+
+	if role > this.Scope {
+		return this.Scope
+	}
+
+	return role
+}
+
+// loadTokens returns the tokens of the token file, which is only read again
+// if it changed. The returned file is shared, it must not be modified.
+func loadTokens() (*TokenFile, error) {
+	filename := cfg().TokenFile
+
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return NewTokenFile(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tokenCache.Lock()
+	defer tokenCache.Unlock()
+
+	if tokenCache.tokens != nil && tokenCache.filename == filename &&
+		tokenCache.modTime.Equal(info.ModTime()) && tokenCache.size == info.Size() {
+		return tokenCache.tokens, nil
+	}
+
+	tokens, err := ReadTokenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenCache.filename = filename
+	tokenCache.modTime = info.ModTime()
+	tokenCache.size = info.Size()
+	tokenCache.tokens = tokens
+
+	return tokens, nil
+}
+
+// changeTokens applies a change to the token file
+func changeTokens(change func(tokens *TokenFile) error) error {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	tokens, err := ReadTokenFile(cfg().TokenFile)
+	if err != nil {
+		return err
+	}
+
+	err = change(tokens)
+	if err != nil {
+		return err
+	}
+
+	return tokens.WriteFile(cfg().TokenFile)
+}
+
+// bearerToken returns the token of the Authorization header, if it has one
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// tokenLogin returns the login of the API token of a request, the token is
+// no longer valid once its user is removed. Users of the identity provider
+// can't be checked, so their tokens only last as long as a session.
+func tokenLogin(r *http.Request) (Login, bool) {
+	value, ok := bearerToken(r)
+	if !ok {
+		return Login{}, false
+	}
+
+	tokens, err := loadTokens()
+	if err != nil {
+		log.Println("Error while reading the tokens:", err)
+		return Login{}, false
+	}
+
+	token, ok := tokens.Check(value)
+	if !ok {
+		return Login{}, false
+	}
+
+	if token.External && time.Now().After(token.Created.Add(sessionLifetime())) {
+		return Login{}, false
+	}
+
+	if !token.External && !userExists(token.User) {
+		return Login{}, false
+	}
+
+	return Login{User: token.User, Groups: token.Groups, External: token.External, Token: &token}, true
+}
+
+// tokenManager returns the login of a request which may manage tokens.
+// Tokens can't be used for it, so a leaked one can't make more of itself.
+func tokenManager(w http.ResponseWriter, r *http.Request) (Login, bool) {
+	login, ok := requestUser(r)
+	if !ok {
+		askLogin(w, r)
+		return Login{}, false
+	}
+
+	if login.Token != nil {
+		http.Error(w, "API tokens can't be used to manage tokens!", http.StatusForbidden)
+		return Login{}, false
+	}
+
+	return login, true
+}
+
+// listTokens returns the tokens of the user, or all of them to the admins
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	login, ok := tokenManager(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := loadTokens()
+	if err != nil {
+		http.Error(w, "Couldn't read the tokens!", http.StatusInternalServerError)
+		log.Println("Error while reading the tokens:", err)
+		return
+	}
+
+	admin := login.Role(c_aclDefault) >= RoleAdmin
+	list := []APIToken{}
+
+	for _, token := range tokens.Tokens {
+		if admin || token.User == login.User {
+			token.Hash = ""
+			list = append(list, token)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	writeJSON(w, list)
+}
+
+// createToken makes a token for the user, its secret is only returned here
+func createToken(w http.ResponseWriter, r *http.Request) {
+	login, ok := tokenManager(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Name    string   `json:"name"`
+		Scope   Role     `json:"scope"`
+		Wikis   []string `json:"wikis"`
+		Expires string   `json:"expires"`
+	}{Scope: RoleRead}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid token: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token := APIToken{
+		User:     login.User,
+		Name:     req.Name,
+		Scope:    req.Scope,
+		Wikis:    req.Wikis,
+		Groups:   login.Groups,
+		External: login.External,
+	}
+
+	if req.Expires != "" {
+		lifetime, err := time.ParseDuration(req.Expires)
+		if err != nil || lifetime <= 0 {
+			http.Error(w, ErrInvalidExpires.Error(), http.StatusBadRequest)
+			return
+		}
+
+		expires := time.Now().Add(lifetime).UTC()
+		token.Expires = &expires
+	}
+
+	// The tokens of the identity provider's users end with their session lifetime
+	if login.External {
+		expires := time.Now().Add(sessionLifetime()).UTC()
+		if token.Expires == nil || token.Expires.After(expires) {
+			token.Expires = &expires
+		}
+	}
+
+	var secret string
+
+	err = changeTokens(func(tokens *TokenFile) error {
+		token, secret, err = tokens.Add(token)
+		return err
+	})
+	if err == ErrInvalidScope {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Couldn't store the token!", http.StatusInternalServerError)
+		log.Println("Error while writing the tokens:", err)
+		return
+	}
+
+	log.Printf("Token '%v' was created by '%v'\n", token.Id, login.User)
+
+	token.Hash = ""
+
+	writeJSONStatus(w, http.StatusCreated, struct {
+		APIToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// revokeToken removes a token of the user, admins may remove any token
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	login, ok := tokenManager(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	admin := login.Role(c_aclDefault) >= RoleAdmin
+
+	err := changeTokens(func(tokens *TokenFile) error {
+		if token, ok := tokens.Tokens[id]; ok && !admin && token.User != login.User {
+			return ErrTokenNotFound
+		}
+
+		return tokens.Remove(id)
+	})
+	if err == ErrTokenNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Couldn't store the tokens!", http.StatusInternalServerError)
+		log.Println("Error while writing the tokens:", err)
+		return
+	}
+
+	log.Printf("Token '%v' was revoked by '%v'\n", id, login.User)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateToken(t *testing.T) {
+	useTestServer(t)
+	router := getRouter()
+
+	id, err := newSession(&Session{User: "oidc:alice", External: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.Lock()
+	csrf := sessions.byId[id].CSRF
+	sessions.Unlock()
+
+	t.Cleanup(func() {
+		deleteSession(id)
+	})
+
+	tests := []struct {
+		name    string
+		session bool
+		body    string
+		expires time.Duration
+	}{
+		{"local user", false, `{"name": "ci", "scope": "write"}`, 0},
+		{"local user with an expiry", false, `{"name": "ci", "expires": "720h"}`, 720 * time.Hour},
+		{"external user", true, `{"name": "ci"}`, sessionLifetime()},
+		{"external user with a longer expiry", true, `{"name": "ci", "expires": "8760h"}`, sessionLifetime()},
+		{"external user with a shorter expiry", true, `{"name": "ci", "expires": "1h"}`, time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/tokens", strings.NewReader(test.body))
+
+			if test.session {
+				req.AddCookie(&http.Cookie{Name: c_sessionCookie, Value: id})
+				req.Header.Set("X-CSRF-Token", csrf)
+			} else {
+				req.SetBasicAuth("tiddlygo", "tiddlygo")
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %v, want %v: %v", rec.Code, http.StatusCreated, rec.Body.String())
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Content-Type = %q, want application/json", ct)
+			}
+
+			var token struct {
+				APIToken
+				Token string `json:"token"`
+			}
+
+			if err := json.Unmarshal(rec.Body.Bytes(), &token); err != nil {
+				t.Fatal(err)
+			}
+
+			if token.Token == "" || token.Hash != "" {
+				t.Fatalf("the response has the hash or no secret: %v", rec.Body.String())
+			}
+
+			if token.External != test.session {
+				t.Fatalf("external = %v, want %v", token.External, test.session)
+			}
+
+			if test.expires == 0 {
+				if token.Expires != nil {
+					t.Fatalf("the token expires at %v", token.Expires)
+				}
+				return
+			}
+
+			if token.Expires == nil {
+				t.Fatal("the token never expires")
+			}
+
+			if lifetime := token.Expires.Sub(token.Created); lifetime < test.expires-time.Minute || lifetime > test.expires {
+				t.Fatalf("the token lasts %v, want %v", lifetime, test.expires)
+			}
+		})
+	}
+}
+
+func TestTokenLogin(t *testing.T) {
+	useTestServer(t)
+
+	users := NewUserFile()
+	if err := users.Add("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := users.WriteFile(cfg().UserFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := NewTokenFile()
+
+	_, local, err := tokens.Add(APIToken{User: "bob", Scope: RoleWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, external, err := tokens.Add(APIToken{User: "oidc:alice", Scope: RoleRead, Groups: []string{"team"}, External: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, outdated, err := tokens.Add(APIToken{User: "oidc:alice", Scope: RoleRead, External: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Made before the external user logged in for the last time
+	old.Created = time.Now().Add(-2 * sessionLifetime())
+	tokens.Tokens[old.Id] = old
+
+	if err := tokens.WriteFile(cfg().TokenFile); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(secret string) (Login, bool) {
+		req := httptest.NewRequest("GET", "/notes.html", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+
+		return tokenLogin(req)
+	}
+
+	if l, ok := login(local); !ok || l.User != "bob" || l.External {
+		t.Fatalf("token of bob: %+v, %v", l, ok)
+	}
+
+	if l, ok := login(external); !ok || l.User != "oidc:alice" || !l.External || strings.Join(l.Groups, ",") != "team" {
+		t.Fatalf("token of alice: %+v, %v", l, ok)
+	}
+
+	if _, ok := login(outdated); ok {
+		t.Fatal("the old token of alice still works")
+	}
+
+	if _, ok := login("tgo_" + old.Id + "_wrong"); ok {
+		t.Fatal("a wrong secret works")
+	}
+
+	if err := users.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := users.WriteFile(cfg().UserFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := login(local); ok {
+		t.Fatal("the token of bob works after bob was removed")
+	}
+}
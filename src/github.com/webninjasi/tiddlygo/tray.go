@@ -0,0 +1,32 @@
+//go:build tray
+// +build tray
+
+package main
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/cratonica/trayhost"
+)
+
+// EnterLoop must be called on the OS's main thread
+func init() {
+	runtime.LockOSThread()
+}
+
+// trayAvailable reports whether the tray icon can be shown,
+// other than on Windows and macOS it needs a display
+func trayAvailable() bool {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return true
+	}
+
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// runTray shows the tray icon of the server at url until it's closed
+func runTray(url string) {
+	trayhost.SetUrl(url)
+	trayhost.EnterLoop("TiddlyGo", iconData)
+}
@@ -0,0 +1,13 @@
+//go:build !tray
+// +build !tray
+
+package main
+
+// Built without the tray tag, e.g. for servers without a desktop,
+// there is no tray icon and trayhost and cgo aren't needed
+func trayAvailable() bool {
+	return false
+}
+
+func runTray(url string) {
+}
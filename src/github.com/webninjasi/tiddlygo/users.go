@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+var (
+	ErrUserExists   = errors.New("There is already a user with that name!")
+	ErrUserNotFound = errors.New("There is no user with that name!")
+	ErrInvalidUser  = errors.New("User names may only have letters, digits and . @ _ -")
+	ErrReservedUser = errors.New("That user name is reserved!")
+)
+
+// User names end up in the html of the wikis, so they're kept simple
+var reUserName = regexp.MustCompile(`^[\w.@-]+$`)
+
+type User struct {
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// UserFile is the JSON file which holds the accounts
+type UserFile struct {
+	Users map[string]User `json:"users"`
+}
+
+// The user file is read again whenever it changes,
+// so the user command works while the server is running
+var userCache = struct {
+	sync.Mutex
+	filename string
+	modTime  time.Time
+	size     int64
+	users    *UserFile
+}{}
+
+// A hash to compare against for unknown users, so they take as long as the others
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("tiddlygo"), bcrypt.DefaultCost)
+
+// checkUserName fails for the names which can't be used by a local user,
+// including the ones which stand for someone else in the ACLs
+func checkUserName(name string) error {
+	if !reUserName.MatchString(name) {
+		return ErrInvalidUser
+	}
+
+	if name == c_anonymousUser || name == c_aclDefault || strings.HasPrefix(name, c_oidcUserPrefix) {
+		return ErrReservedUser
+	}
+
+	return nil
+}
+
+func NewUserFile() *UserFile {
+	return &UserFile{
+		Users: map[string]User{},
+	}
+}
+
+// ReadUserFile reads the accounts, a missing file has none
+func ReadUserFile(filename string) (*UserFile, error) {
+	users := NewUserFile()
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, users)
+	if err != nil {
+		return nil, err
+	}
+
+	if users.Users == nil {
+		users.Users = map[string]User{}
+	}
+
+	return users, nil
+}
+
+// WriteFile writes the accounts readable only by the owner
+func (this *UserFile) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(this, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+// Names returns the user names sorted
+func (this *UserFile) Names() []string {
+	names := make([]string, 0, len(this.Users))
+
+	for name := range this.Users {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (this *UserFile) Add(name string, password string) error {
+	if err := checkUserName(name); err != nil {
+		return err
+	}
+
+	if _, ok := this.Users[name]; ok {
+		return ErrUserExists
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	this.Users[name] = User{
+		Hash:    string(hash),
+		Created: time.Now().UTC(),
+	}
+
+	return nil
+}
+
+func (this *UserFile) SetPassword(name string, password string) error {
+	user, ok := this.Users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	user.Hash = string(hash)
+	this.Users[name] = user
+
+	return nil
+}
+
+func (this *UserFile) Remove(name string) error {
+	if _, ok := this.Users[name]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(this.Users, name)
+
+	return nil
+}
+
+// Check reports whether the password of the user matches
+func (this *UserFile) Check(name string, password string) bool {
+	user, ok := this.Users[name]
+	if !ok || checkUserName(name) != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)) == nil
+}
+
+// localUsers returns the names of the users who log in with a password,
+// which is the user of the config until the first user is added
+func localUsers() []string {
+	users, err := loadUsers()
+	if err != nil {
+		log.Println("Error while reading the users:", err)
+		return []string{}
+	}
+
+	if len(users.Users) == 0 {
+		if cfg().Username == "" {
+			return []string{}
+		}
+
+		return []string{cfg().Username}
+	}
+
+	return users.Names()
+}
+
+// loadUsers returns the accounts of the user file, which is only read again
+// if it changed. The returned file is shared, it must not be modified.
+func loadUsers() (*UserFile, error) {
+	filename := cfg().UserFile
+
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return NewUserFile(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	userCache.Lock()
+	defer userCache.Unlock()
+
+	if userCache.users != nil && userCache.filename == filename &&
+		userCache.modTime.Equal(info.ModTime()) && userCache.size == info.Size() {
+		return userCache.users, nil
+	}
+
+	users, err := ReadUserFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	userCache.filename = filename
+	userCache.modTime = info.ModTime()
+	userCache.size = info.Size()
+	userCache.users = users
+
+	return users, nil
+}
+
+const c_userUsage = `Usage: tiddlygo user <command> [name]
+
+Commands:
+  add <name>      Add a user, the password is asked for
+  passwd <name>   Change the password of a user
+  remove <name>   Remove a user
+  list            List the users`
+
+// userCommand manages the accounts in the user file from the command line
+func userCommand(args []string) error {
+	if len(args) < 1 || (args[0] != "list" && len(args) != 2) {
+		return errors.New(c_userUsage)
+	}
+
+	users, err := ReadUserFile(cfg().UserFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		// Check the name before asking for the password
+		if err := checkUserName(args[1]); err != nil {
+			return err
+		}
+
+		if _, ok := users.Users[args[1]]; ok {
+			return ErrUserExists
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		err = users.Add(args[1], password)
+		if err != nil {
+			return err
+		}
+	case "passwd":
+		if _, ok := users.Users[args[1]]; !ok {
+			return ErrUserNotFound
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		err = users.SetPassword(args[1], password)
+		if err != nil {
+			return err
+		}
+	case "remove":
+		err = users.Remove(args[1])
+		if err != nil {
+			return err
+		}
+	case "list":
+		for _, name := range users.Names() {
+			fmt.Println(name)
+		}
+
+		return nil
+	default:
+		return errors.New(c_userUsage)
+	}
+
+	err = users.WriteFile(cfg().UserFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated the users in '%v'\n", cfg().UserFile)
+
+	return nil
+}
+
+// readPassword asks for a new password twice on a terminal,
+// otherwise it reads a line from the standard input for scripts
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(repeated) {
+		return "", errors.New("The passwords do not match!")
+	}
+
+	return checkPassword(string(password))
+}
+
+func checkPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("The password can't be empty!")
+	}
+
+	return password, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserNames(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"alice", nil},
+		{"alice.smith@example.com", nil},
+		{"bob_2-b", nil},
+		{"", ErrInvalidUser},
+		{"alice smith", ErrInvalidUser},
+		{"<b>alice</b>", ErrInvalidUser},
+		{"anonymous", ErrReservedUser},
+		{"*", ErrInvalidUser},
+		{"oidc:alice", ErrInvalidUser},
+	}
+
+	for _, test := range tests {
+		users := NewUserFile()
+
+		if err := users.Add(test.name, "secret"); err != test.err {
+			t.Errorf("add %q: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// The reserved names are kept even if the pattern allows them one day
+	for _, name := range []string{c_anonymousUser, c_aclDefault, c_oidcUserPrefix + "alice"} {
+		if err := checkUserName(name); err == nil {
+			t.Errorf("%q can be used", name)
+		}
+	}
+}
+
+func TestUserFile(t *testing.T) {
+	users := NewUserFile()
+
+	if err := users.Add("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := users.Add("alice", "other"); err != ErrUserExists {
+		t.Fatalf("add of an existing user: got %v, want %v", err, ErrUserExists)
+	}
+
+	if strings.HasPrefix(users.Users["alice"].Hash, "secret") || users.Users["alice"].Created.IsZero() {
+		t.Fatalf("user = %+v", users.Users["alice"])
+	}
+
+	if !users.Check("alice", "secret") || users.Check("alice", "Secret") || users.Check("bob", "secret") {
+		t.Fatal("the passwords aren't checked")
+	}
+
+	if err := users.SetPassword("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if users.Check("alice", "secret") || !users.Check("alice", "changed") {
+		t.Fatal("the password wasn't changed")
+	}
+
+	if err := users.SetPassword("bob", "secret"); err != ErrUserNotFound {
+		t.Fatalf("passwd of a missing user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	// A reserved name put in the file by hand can't log in
+	users.Users[c_anonymousUser] = users.Users["alice"]
+
+	if users.Check(c_anonymousUser, "changed") {
+		t.Fatal("a reserved user logged in")
+	}
+
+	delete(users.Users, c_anonymousUser)
+
+	filename := filepath.Join(t.TempDir(), "users.json")
+
+	if err := users.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("stat = %v, %v, want it readable only by the owner", info, err)
+	}
+
+	read, err := ReadUserFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(read.Names(), ",") != "alice" || !read.Check("alice", "changed") {
+		t.Fatalf("read users = %v", read.Names())
+	}
+
+	if err := read.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := read.Remove("alice"); err != ErrUserNotFound {
+		t.Fatalf("remove of a missing user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	if read.Check("alice", "changed") {
+		t.Fatal("a removed user logged in")
+	}
+
+	// A missing file has no users
+	missing, err := ReadUserFile(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || len(missing.Users) != 0 {
+		t.Fatalf("missing file: %v, %v", missing, err)
+	}
+}
+
+// useStdin makes the input the standard input of the test
+func useStdin(t *testing.T, input string) {
+	filename := filepath.Join(t.TempDir(), "stdin")
+
+	err := ioutil.WriteFile(filename, []byte(input), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldStdin := os.Stdin
+
+	t.Cleanup(func() {
+		os.Stdin = oldStdin
+		f.Close()
+	})
+
+	os.Stdin = f
+}
+
+func TestUserCommand(t *testing.T) {
+	useTestServer(t)
+
+	tests := []struct {
+		name  string
+		args  []string
+		input string
+		err   error
+	}{
+		{"add", []string{"add", "alice"}, "secret\n", nil},
+		{"add existing", []string{"add", "alice"}, "secret\n", ErrUserExists},
+		{"add reserved", []string{"add", "anonymous"}, "secret\n", ErrReservedUser},
+		{"add invalid", []string{"add", "alice smith"}, "secret\n", ErrInvalidUser},
+		{"add bob", []string{"add", "bob"}, "bob's\r\n", nil},
+		{"passwd", []string{"passwd", "alice"}, "changed\n", nil},
+		{"passwd missing", []string{"passwd", "carol"}, "secret\n", ErrUserNotFound},
+		{"remove", []string{"remove", "bob"}, "", nil},
+		{"remove missing", []string{"remove", "bob"}, "", ErrUserNotFound},
+	}
+
+	for _, test := range tests {
+		useStdin(t, test.input)
+
+		if err := userCommand(test.args); err != test.err {
+			t.Fatalf("%v: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	users, err := ReadUserFile(cfg().UserFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(users.Names(), ",") != "alice" || !users.Check("alice", "changed") {
+		t.Fatalf("users = %v", users.Names())
+	}
+
+	// An empty password isn't taken
+	useStdin(t, "\n")
+
+	if err := userCommand([]string{"passwd", "alice"}); err == nil {
+		t.Fatal("an empty password was taken")
+	}
+
+	for _, args := range [][]string{{}, {"add"}, {"rename", "alice"}} {
+		if err := userCommand(args); err == nil || !strings.HasPrefix(err.Error(), "Usage:") {
+			t.Fatalf("%v: got %v, want the usage", args, err)
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"runtime"
 	"strings"
 )
 
@@ -12,6 +19,41 @@ func isExist(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// wikiETag returns the current ETag of a wiki or "" if it doesn't exist
+func wikiETag(wikiname string) (string, error) {
+	content, err := readWiki(wikiname)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return contentETag(content), nil
+}
+
+func hashETag(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// matchETag checks an If-Match header value against the current ETag.
+// An empty etag means that the file doesn't exist.
+func matchETag(ifMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+		if tag == "*" && etag != "" {
+			return true
+		}
+
+		if etag != "" && (tag == etag || `"`+tag+`"` == etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func parseOptions(optionsStr string) map[string]string {
 	optsMap := make(map[string]string)
 	opts := strings.Split(optionsStr, ";")
@@ -27,48 +69,49 @@ func parseOptions(optionsStr string) map[string]string {
 	return optsMap
 }
 
-// Source: http://stackoverflow.com/a/33853856
-func downloadFile(filepath string, url string) (err error) {
-	// Create the file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Get the data
+// downloadWiki stores the wiki at url as the new wiki wikiname
+func downloadWiki(wikiname string, url string, user string) error {
 	resp, err := http.Get(url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return createWiki(wikiname, content, user)
 }
 
-func toHttpAddr(addr string) string {
+// toHttpAddr returns the URL of the server at addr, an https one with TLS
+func toHttpAddr(addr string, secure bool) string {
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+
 	addr_parts := strings.SplitN(addr, ":", 2)
 
 	if addr_parts[0] == "" {
 		addr_parts[0] = "127.0.0.1"
 	}
 
-	if addr_parts[1] == "" {
-		return "http://" + addr_parts[0]
+	if len(addr_parts) < 2 || addr_parts[1] == "" {
+		return scheme + addr_parts[0]
 	}
 
-	return "http://" + addr_parts[0] + ":" + addr_parts[1]
+	return scheme + addr_parts[0] + ":" + addr_parts[1]
 }
 
 func checkWikiDir() error {
-	if !isExist(cfg.WikiDir) {
-		err := os.MkdirAll(cfg.WikiDir, 0644)
+	if !isExist(cfg().WikiDir) {
+		err := os.MkdirAll(cfg().WikiDir, 0755)
 		if err != nil {
 			return err
 		}
@@ -76,3 +119,77 @@ func checkWikiDir() error {
 
 	return nil
 }
+
+// fileMode returns the permissions of an existing file or def if there is none
+func fileMode(path string, def os.FileMode) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		return def
+	}
+
+	return info.Mode().Perm()
+}
+
+// syncDir flushes a directory entry, e.g. after renaming a file inside it
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	err = dir.Sync()
+	if err != nil && runtime.GOOS == "windows" {
+		// Directories can't be synced on windows
+		return nil
+	}
+
+	return err
+}
+
+// validateWiki checks whether the content looks like a TiddlyWiki html document
+func validateWiki(inp io.Reader) error {
+	r := bufio.NewReaderSize(inp, 64<<10)
+
+	head, err := r.Peek(4 << 10)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	if !bytes.Contains(bytes.ToLower(head), []byte("<html")) {
+		return ErrInvalidWiki
+	}
+
+	// Look for the store area of TiddlyWiki Classic or TiddlyWiki5
+	markers := [][]byte{
+		[]byte(`id="storeArea"`),
+		[]byte(`class="tiddlywiki-tiddler-store"`),
+	}
+
+	var tail []byte
+	buf := make([]byte, 64<<10)
+
+	for {
+		n, err := r.Read(buf)
+		chunk := append(tail, buf[:n]...)
+
+		for _, marker := range markers {
+			if bytes.Contains(chunk, marker) {
+				return nil
+			}
+		}
+
+		if len(chunk) > 64 {
+			tail = append([]byte{}, chunk[len(chunk)-64:]...)
+		} else {
+			tail = chunk
+		}
+
+		if err == io.EOF {
+			return ErrInvalidWiki
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type WikiVersion struct {
+	Id     string    `json:"id"`
+	Url    string    `json:"url"`
+	Size   int64     `json:"size"`
+	Time   time.Time `json:"time"`
+	Author string    `json:"author,omitempty"`
+}
+
+func listVersions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := versionWikiName(params)
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	data, err := wikiVersions(wikiname)
+	if err != nil {
+		http.Error(w, "Couldn't list the versions!", http.StatusInternalServerError)
+		log.Printf("Error while listing versions of '%v': %v\n", wikiname, err)
+		return
+	}
+
+	byt, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byt)
+}
+
+// versionWikiName returns the wiki of a versions route, which names it
+// without .html, e.g. /wikis/notes/versions
+func versionWikiName(params map[string]string) string {
+	return strings.TrimSuffix(params["wikiname"], ".html") + ".html"
+}
+
+// wikiVersions returns the revisions of a wiki if the store keeps them,
+// otherwise its backups
+func wikiVersions(wikiname string) ([]WikiVersion, error) {
+	versions := []WikiVersion{}
+
+	if hs, ok := wikiStore().(HistoryStore); ok {
+		revisions, err := hs.Revisions(wikiname)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, revision := range revisions {
+			versions = append(versions, WikiVersion{
+				Id:     revision.Id,
+				Url:    "/wikis/" + strings.TrimSuffix(wikiname, ".html") + "/versions/" + revision.Id,
+				Size:   revision.Size,
+				Time:   revision.Time,
+				Author: revision.Author,
+			})
+		}
+
+		return versions, nil
+	}
+
+	backups, err := listBackups(wikiname)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, backup := range backups {
+		versions = append(versions, WikiVersion{
+			Id:   backup.Id,
+			Url:  "/wikis/" + strings.TrimSuffix(wikiname, ".html") + "/versions/" + backup.Id,
+			Size: backup.Size,
+			Time: backup.Time,
+		})
+	}
+
+	return versions, nil
+}
+
+// viewVersion serves an old copy of a wiki. It can't be saved in place
+// since there is no PUT route for it.
+func viewVersion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := versionWikiName(params)
+
+	if _, ok := authorize(w, r, wikiname, RoleRead); !ok {
+		return
+	}
+
+	inp, err := openVersion(w, wikiname, params["id"])
+	if err != nil {
+		return
+	}
+	defer inp.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	io.Copy(w, inp)
+}
+
+// restoreVersion stores an old copy of a wiki as its current version
+func restoreVersion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	wikiname := versionWikiName(params)
+
+	user, ok := authorize(w, r, wikiname, RoleWrite)
+	if !ok {
+		return
+	}
+
+	inp, err := openVersion(w, wikiname, params["id"])
+	if err != nil {
+		return
+	}
+	defer inp.Close()
+
+	_, err = saveWiki(wikiname, inp, "", user)
+	if err != nil {
+		http.Error(w, "Couldn't restore the version!", http.StatusInternalServerError)
+		log.Printf("Error while restoring '%v' of '%v': %v\n", params["id"], wikiname, err)
+		return
+	}
+
+	fmt.Fprintf(w, "Restored '%v' from %v", wikiname, params["id"])
+	log.Printf("Successfully restored: '%v' from %v\n", wikiname, params["id"])
+}
+
+// openVersion opens a revision or a backup and writes an error response if it fails
+func openVersion(w http.ResponseWriter, wikiname string, id string) (io.ReadCloser, error) {
+	var inp io.ReadCloser
+	var err error
+
+	if hs, ok := wikiStore().(HistoryStore); ok {
+		inp, err = hs.OpenRevision(wikiname, id)
+	} else {
+		var backup Backup
+
+		backup, err = findBackup(wikiname, id)
+		if err == nil {
+			inp, err = openBackup(backup)
+		}
+	}
+	if err == nil {
+		return inp, nil
+	}
+
+	if os.IsNotExist(err) {
+		http.Error(w, "Couldn't find the version!", http.StatusNotFound)
+		return nil, err
+	}
+
+	http.Error(w, "Couldn't open the version!", http.StatusInternalServerError)
+	log.Printf("Error while opening '%v' of '%v': %v\n", id, wikiname, err)
+
+	return nil, err
+}
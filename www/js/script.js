@@ -1,6 +1,22 @@
+updateSession();
 updateWikiList();
 updateTemplateList();
 
+// Changes need a login, which is made on the login page
+$(document).ajaxError(function(event, jqXHR) {
+	if (jqXHR.status == 401) {
+		window.location.href = '/login?next=' + encodeURIComponent(window.location.pathname);
+	}
+});
+
+$('.session').on('click', '[data-logout]', function(event) {
+	$.post('/logout').always(function() {
+		window.location.reload();
+	});
+
+	event.preventDefault();
+});
+
 $('form[data-live]').on('submit', function(event) {
 	var $form = $(this);
 	var $target = $($form.data('target'));
@@ -26,6 +42,54 @@ $('form[data-live]').on('submit', function(event) {
 	event.preventDefault();
 });
 
+$('.page-list').on('click', '[data-versions]', function(event) {
+	var wikiname = $(this).data('versions');
+
+	$('.versions-wikiname').text(wikiname);
+	$('#versionsOutput').empty();
+	updateVersionList(wikiname);
+	$('#versions').data('wikiname', wikiname).modal('show');
+
+	event.preventDefault();
+});
+
+$('.version-list').on('click', '[data-restore]', function(event) {
+	var wikiname = $('#versions').data('wikiname');
+
+	$.ajax({
+		url : $(this).data('restore'),
+		method : 'POST',
+	}).done(function(data, textStatus, jqXHR) {
+		$('#versionsOutput').html(tplSuccess({
+			data : data
+		}));
+		updateVersionList(wikiname);
+	}).fail(function(jqXHR, textStatus, errorThrown) {
+		$('#versionsOutput').html(tplError({
+			data : jqXHR.responseText
+		}));
+	});
+
+	event.preventDefault();
+});
+
+function updateSession() {
+	$.getJSON("/session", function(data) {
+		$.ajaxSetup({
+			headers : {
+				'X-CSRF-Token' : data.csrf
+			}
+		});
+		$(".session").html(tplSession(data));
+	});
+}
+
+function updateVersionList(wikiname) {
+	$.getJSON("/wikis/" + wikiname.replace(/\.html$/, "") + "/versions", function(data) {
+		$(".version-list").html(tplVersionList(data));
+	});
+}
+
 function updateWikiList() {
 	$.getJSON("/wikilist", function(data) {
 		$(".page-list").html(tplPageList(data));
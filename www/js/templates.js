@@ -3,6 +3,10 @@ var tplSuccess = doT
 var tplError = doT
 		.template('<div class="alert alert-danger"><strong>Error</strong> <span>{{=it.data}}</span></div>');
 var tplPageList = doT
-		.template('{{~it.pages :page:pidx}}<a href="{{=page.url}}" class="list-group-item">{{=page.name}}</a>{{~}}');
+		.template('{{~it.pages :page:pidx}}<a href="{{=page.url}}" class="list-group-item">{{=page.name}}<span class="btn btn-xs btn-default pull-right" data-versions="{{=page.name}}">Versions</span></a>{{~}}');
+var tplVersionList = doT
+		.template('{{~it :ver:vidx}}<div class="list-group-item"><a href="{{=ver.url}}" target="_blank">{{=new Date(ver.time).toLocaleString()}}</a> <small class="text-muted">{{=Math.ceil(ver.size / 1024)}} KB{{? ver.author }} by {{!ver.author}}{{?}}</small><button type="button" class="btn btn-xs btn-warning pull-right" data-restore="{{=ver.url}}/restore">Restore</button></div>{{~}}{{? !it.length }}<div class="list-group-item">No versions yet.</div>{{?}}');
+var tplSession = doT
+		.template('{{? it.user }}<span class="text-muted">{{!it.user}}</span> <button type="button" class="btn btn-xs btn-default" data-logout>Log out</button>{{??}}<a href="/login" class="btn btn-xs btn-default">Log in</a>{{?}}');
 var tplWikiTemplates = doT
 		.template('{{~it :tpl:idx}}<option value="{{=tpl.id}}"{{? tpl.selected }} selected{{?}}>{{=tpl.name}}</option>{{~}}');